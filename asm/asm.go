@@ -0,0 +1,359 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package asm is an assembler for the PRU instruction set, accepting the
+// source syntax of the TI pasm assembler so that existing PRU programs can be
+// assembled without external tools, either at go generate time or at runtime e.g
+//
+//	prog, err := asm.AssembleFile("prucode.p")
+//	...
+//	err = u.LoadAt(prog.Code, 0)
+//	err = u.RunAt(prog.Entry)
+//
+// The following is supported:
+//
+//	Comments using ';', '//' and '/* ... */'
+//	#define, #undef, #ifdef, #ifndef, #else, #endif, #include
+//	.origin, .entrypoint, .setcallreg, .codeword
+//	.struct, .u8, .u16, .u32, .ends, .assign, SIZE() and OFFSET()
+//	.macro, .mparam, .endm
+//	Labels, and constant expressions using C operators.
+//
+// The instructions of the PRU core (version 3, as used on the AM335x) are supported,
+// along with the pasm pseudo instructions (MOV, CALL, RET, WBS, WBC, NOP, ZERO, FILL).
+// MOV of a value larger than 16 bits to a 32 bit register generates 2 LDI
+// instructions. ZERO and FILL are encoded as XIN from the device IDs 255 and 254.
+// The register indirect MVIB, MVIW and MVID instructions are not supported, nor are
+// the instructions that are not part of core version 3 (SCAN, LFC, STC, SXIN, SXOUT
+// and SXCHG); these are rejected with an error.
+package asm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	iramSize = 8 * 1024 // Size of PRU instruction RAM in bytes
+	maxDepth = 32       // Maximum nesting of includes, macros and defines
+)
+
+// Program is an assembled PRU program.
+type Program struct {
+	Code   []uint32        // Instruction words, starting at address 0.
+	Entry  uint            // Byte address of the entry point.
+	Labels map[string]uint // Byte address of each label.
+}
+
+// srcLine is a line of preprocessed source.
+type srcLine struct {
+	file string
+	line int
+	text string
+}
+
+// assembler holds the state of the program being assembled.
+type assembler struct {
+	open    func(string) ([]byte, error)
+	defines map[string]string
+	macros  map[string]*macro
+	structs map[string]*structDef
+	assigns map[string]*assign
+	lines   []srcLine
+
+	// Preprocessor state
+	cond     []bool     // Nested conditional states
+	inactive int        // Count of conditionals that are false
+	defMacro *macro     // Macro being defined
+	defStr   *structDef // Structure being defined
+
+	// Assembly state
+	final   bool // Set on final pass, when all symbols must be defined.
+	pc      int  // Word address of next instruction
+	labels  map[string]int
+	code    []uint32
+	used    []bool
+	entry   string
+	callReg reg
+}
+
+// Assemble assembles the source, using name in error messages. Files
+// included using #include are read relative to the directory of name.
+func Assemble(name string, src []byte) (*Program, error) {
+	return AssembleWithDefines(name, src, nil)
+}
+
+// AssembleWithDefines assembles the source with an initial set of #define values.
+func AssembleWithDefines(name string, src []byte, defines map[string]string) (*Program, error) {
+	a := newAssembler(defines)
+	return a.assemble(name, src)
+}
+
+// AssembleFile reads and assembles the source file.
+func AssembleFile(name string) (*Program, error) {
+	return AssembleFileWithDefines(name, nil)
+}
+
+// AssembleFileWithDefines reads and assembles the source file with an initial set of #define values.
+func AssembleFileWithDefines(name string, defines map[string]string) (*Program, error) {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	a := newAssembler(defines)
+	return a.assemble(name, src)
+}
+
+func newAssembler(defines map[string]string) *assembler {
+	a := &assembler{
+		open:    os.ReadFile,
+		defines: make(map[string]string),
+		macros:  make(map[string]*macro),
+		structs: make(map[string]*structDef),
+		assigns: make(map[string]*assign),
+		labels:  make(map[string]int),
+		callReg: reg{n: 30, sel: selW0, bit: -1},
+	}
+	for k, v := range defines {
+		a.defines[k] = v
+	}
+	return a
+}
+
+// assemble preprocesses the source, and then assembles it in 2 passes.
+// The first pass determines the address of the labels.
+func (a *assembler) assemble(name string, src []byte) (*Program, error) {
+	if err := a.preprocess(name, src, 0); err != nil {
+		return nil, err
+	}
+	if a.defMacro != nil {
+		return nil, fmt.Errorf("%s: missing .endm for macro %s", name, a.defMacro.name)
+	}
+	if a.defStr != nil {
+		return nil, fmt.Errorf("%s: missing .ends for struct %s", name, a.defStr.name)
+	}
+	if len(a.cond) != 0 {
+		return nil, fmt.Errorf("%s: missing #endif", name)
+	}
+	if err := a.pass(false); err != nil {
+		return nil, err
+	}
+	if err := a.pass(true); err != nil {
+		return nil, err
+	}
+	p := &Program{Code: a.code, Labels: make(map[string]uint)}
+	for l, v := range a.labels {
+		p.Labels[l] = uint(v) * 4
+	}
+	if a.entry != "" {
+		v, ok := a.labels[a.entry]
+		if !ok {
+			return nil, fmt.Errorf("%s: entrypoint %s is not defined", name, a.entry)
+		}
+		p.Entry = uint(v) * 4
+	}
+	return p, nil
+}
+
+// pass makes one pass over the preprocessed source.
+func (a *assembler) pass(final bool) error {
+	a.final = final
+	a.pc = 0
+	a.code = nil
+	a.used = nil
+	a.callReg = reg{n: 30, sel: selW0, bit: -1}
+	for _, l := range a.lines {
+		if err := a.line(l.text); err != nil {
+			return fmt.Errorf("%s:%d: %v", l.file, l.line, err)
+		}
+	}
+	return nil
+}
+
+// line assembles one line of source.
+func (a *assembler) line(s string) error {
+	labels, s := splitLabels(s)
+	for _, l := range labels {
+		if !a.final {
+			if _, ok := a.labels[l]; ok {
+				return fmt.Errorf("label %s redefined", l)
+			}
+			a.labels[l] = a.pc
+		}
+	}
+	if s == "" {
+		return nil
+	}
+	op, args := splitOp(s)
+	if op[0] == '.' {
+		return a.directive(strings.ToLower(op), args)
+	}
+	return a.instruction(strings.ToUpper(op), args)
+}
+
+// directive processes the dot commands used during assembly.
+func (a *assembler) directive(op string, args []string) error {
+	switch op {
+	case ".origin":
+		if len(args) != 1 {
+			return fmt.Errorf(".origin requires an address")
+		}
+		v, err := a.eval(args[0])
+		if err != nil {
+			return err
+		}
+		if v < 0 || v >= iramSize/4 {
+			return fmt.Errorf(".origin %d is out of range", v)
+		}
+		a.pc = int(v)
+	case ".entrypoint":
+		if len(args) != 1 {
+			return fmt.Errorf(".entrypoint requires a label")
+		}
+		a.entry = args[0]
+	case ".setcallreg":
+		if len(args) != 1 {
+			return fmt.Errorf(".setcallreg requires a register")
+		}
+		r, ok, err := a.register(args[0])
+		if err != nil {
+			return err
+		}
+		if !ok || r.width() != 2 {
+			return fmt.Errorf(".setcallreg requires a 16 bit register field")
+		}
+		a.callReg = r
+	case ".codeword":
+		if len(args) != 1 {
+			return fmt.Errorf(".codeword requires a value")
+		}
+		v, err := a.eval(args[0])
+		if err != nil {
+			return err
+		}
+		return a.emit(uint32(v))
+	default:
+		return fmt.Errorf("unknown directive %s", op)
+	}
+	return nil
+}
+
+// emit stores the instruction word at the current address.
+func (a *assembler) emit(w uint32) error {
+	if a.pc >= iramSize/4 {
+		return fmt.Errorf("program too large")
+	}
+	for len(a.code) <= a.pc {
+		a.code = append(a.code, 0)
+		a.used = append(a.used, false)
+	}
+	if a.used[a.pc] {
+		return fmt.Errorf("code overlaps at address 0x%x", a.pc)
+	}
+	a.code[a.pc] = w
+	a.used[a.pc] = true
+	a.pc++
+	return nil
+}
+
+// symbol returns the value of a label. During the first pass, undefined
+// labels have a value of 0.
+func (a *assembler) symbol(s string) (int64, error) {
+	if v, ok := a.labels[s]; ok {
+		return int64(v), nil
+	}
+	if !a.final {
+		return 0, nil
+	}
+	return 0, fmt.Errorf("undefined symbol %s", s)
+}
+
+// splitLabels removes the labels from the start of the line.
+func splitLabels(s string) ([]string, string) {
+	var labels []string
+	for {
+		s = strings.TrimSpace(s)
+		i := 0
+		for i < len(s) && isIdent(s[i]) && s[i] != '.' {
+			i++
+		}
+		if i == 0 || i >= len(s) || s[i] != ':' || (s[0] >= '0' && s[0] <= '9') {
+			return labels, s
+		}
+		labels = append(labels, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// splitOp splits the line into the opcode and the comma separated operands.
+func splitOp(s string) (string, []string) {
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, nil
+	}
+	return s[:i], splitArgs(s[i+1:])
+}
+
+// splitArgs splits the comma separated operands, ignoring commas within parentheses.
+func splitArgs(s string) []string {
+	var args []string
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+// WriteBin writes the program as little-endian binary words, as
+// generated by pasm using the -b option.
+func (p *Program) WriteBin(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, p.Code)
+}
+
+// WriteImg writes the program as one hex word per line, as
+// generated by pasm using the -m option.
+func (p *Program) WriteImg(w io.Writer) error {
+	for _, c := range p.Code {
+		if _, err := fmt.Fprintf(w, "%08x\n", c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includePath returns the path of an included file, relative to the including file.
+func includePath(from, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(from), name)
+}
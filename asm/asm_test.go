@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestExamples assembles the example programs, and compares the output
+// against the binary or image files generated by pasm.
+func TestExamples(t *testing.T) {
+	files, err := filepath.Glob("../examples/*/*.p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no example programs found")
+	}
+	for _, f := range files {
+		p, err := AssembleFile(f)
+		if err != nil {
+			t.Errorf("%s: %v", f, err)
+			continue
+		}
+		base := strings.TrimSuffix(f, ".p")
+		var got bytes.Buffer
+		var golden string
+		if _, err := os.Stat(base + ".bin"); err == nil {
+			golden = base + ".bin"
+			err = p.WriteBin(&got)
+		} else {
+			golden = base + ".img"
+			err = p.WriteImg(&got)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s: %v", f, err)
+			continue
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("%s: output does not match %s", f, golden)
+		}
+	}
+}
+
+// instructionTest is the expected encoding of an instruction at an address.
+type instructionTest struct {
+	addr uint
+	src  string
+	word uint32
+}
+
+// Instructions and their encodings taken from the binary files generated
+// by pasm for the example programs.
+var pasmInstructions = []instructionTest{
+	// examples/counter/prucounter.bin
+	{0x0000, "LDI r0, 0", 0x240000e0},
+	{0x0004, "LDI r8, 0x64", 0x240064e8},
+	{0x0008, "LBBO &r2, r0, 0, 4", 0xf1002082},
+	{0x0010, "CLR r3, r3, 3", 0x1d03e3e3},
+	{0x0018, "SBBO &r0, r2, 0xc, 4", 0xe10c2280},
+	{0x001c, "SET r3, r3, 3", 0x1f03e3e3},
+	{0x0024, "SUB r8, r8, 1", 0x0501e8e8},
+	{0x0028, "QBNE 0x9, r8, 0", 0x6f00e8ff},
+	{0x002c, "LBBO &r4, r2, 0xc, 8", 0xf10c6284},
+	{0x0030, "SBBO &r4, r0, 4, 8", 0xe1046084},
+	{0x0034, "HALT", 0x2a000000},
+	// examples/dual/prucode.bin
+	{0x0004, "LBBO &r0, r8, 0, 16", 0xf100e880},
+	{0x0010, "ADD r2, r2, 4", 0x0104e2e2},
+	{0x001c, "QBNE 0x2, r1, 0", 0x6f00e1fb},
+	{0x0020, "OR r31.b0, r0, 0x20", 0x1320e01f},
+	// examples/gpio/prugpio.bin
+	{0x000c, "MOV r6, r2", 0x10e2e2e6},
+	{0x0014, "QBEQ 0xd, r6, 0", 0x5100e608},
+	{0x001c, "QBBS 0xa, r31, r10", 0xd0eaff03},
+	{0x0020, "CLR r30, r30, r11", 0x1cebfefe},
+	{0x0024, "QBA 0xb", 0x79000002},
+	{0x0028, "SET r30, r30, r11", 0x1eebfefe},
+	{0x0034, "QBBC 0x2, r31, r1", 0xcee1fff5},
+	// examples/event/pruevent.bin
+	{0x0000, "LDI r31.b0, 0x20", 0x2400201f},
+}
+
+// Encodings of instructions that are not used by the example programs,
+// derived from the instruction formats in the PRU reference guide.
+var formatInstructions = []instructionTest{
+	{0, "ADD r1, r1, 1", 0x0101e1e1},
+	{0, "LDI r5.w2, 0xffff", 0x24ffffc5},
+	{0, "SBCO &r3.b1, c24, 4, 2", 0x810418a3},
+	{0, "XIN 10, &r2, 36", 0x2e851182},
+	{0, "XOUT 11, &r3.b1, 4", 0x2f0581a3},
+	{0, "XCHG 12, &r4, 8", 0x2f860384},
+	{0, "LOOP 0x5, 5", 0x31040005},
+	{0, "ILOOP 0x2, r2.w0", 0x30828002},
+	{0, "LOOP 0x11, 256", 0x31ff0011},
+	{0, "ZERO &r5, 7", 0x2eff8305},
+	{0, "ZERO &r0, 124", 0x2effbd80},
+	{0, "FILL &r5, 7", 0x2eff0305},
+	{0, "FILL &r1.b3, 1", 0x2eff0061},
+}
+
+// TestInstructions checks the encoding of single instructions, and
+// that the disassembler decodes them to the same source.
+func TestInstructions(t *testing.T) {
+	for _, tc := range append(pasmInstructions, formatInstructions...) {
+		a := newAssembler(nil)
+		a.final = true
+		a.pc = int(tc.addr / 4)
+		if err := a.line(tc.src); err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		if a.pc != int(tc.addr/4)+1 || a.code[tc.addr/4] != tc.word {
+			t.Errorf("%s: got %08x, want %08x", tc.src, a.code[tc.addr/4:], tc.word)
+			continue
+		}
+		if s := Decode(tc.word, tc.addr); s != tc.src {
+			t.Errorf("%08x: decoded as %q, want %q", tc.word, s, tc.src)
+		}
+	}
+}
+
+// TestErrors checks that invalid instructions are rejected.
+func TestErrors(t *testing.T) {
+	for _, src := range []string{
+		"LOOP 0x1, 5",
+		"LOOP 0x300, 5",
+		"LOOP 0x5, 0",
+		"LOOP 0x5, 257",
+		"XIN 256, &r2, 4",
+		"XIN 10, &r2, 0",
+		"XIN 10, &r2, 125",
+		"ZERO &r31, 8",
+		"ZERO &r5, 0",
+		"FILL &r0, 125",
+		"MVIB r1, r2",
+		"SCAN r1, 4",
+	} {
+		a := newAssembler(nil)
+		a.final = true
+		if err := a.line(src); err == nil {
+			t.Errorf("%s: expected error", src)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"fmt"
+	"io"
+)
+
+// Inst is a disassembled instruction.
+type Inst struct {
+	Addr uint   // Byte address of the instruction
+	Word uint32 // Instruction word
+	Text string // Mnemonic and operands
+}
+
+// String formats the instruction in the style of a pasm listing,
+// with the word address, the instruction word and the instruction.
+func (i Inst) String() string {
+	return fmt.Sprintf("0x%04x: 0x%08x  %s", i.Addr/4, i.Word, i.Text)
+}
+
+// Disassemble decodes the program, where addr is the byte address of the first word.
+func Disassemble(code []uint32, addr uint) []Inst {
+	var l []Inst
+	for i, w := range code {
+		a := addr + uint(i)*4
+		l = append(l, Inst{Addr: a, Word: w, Text: Decode(w, a)})
+	}
+	return l
+}
+
+// Listing writes the disassembled program, one instruction per line.
+func Listing(w io.Writer, code []uint32, addr uint) error {
+	for _, i := range Disassemble(code, addr) {
+		if _, err := fmt.Fprintln(w, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode returns the instruction word as pasm source, where addr is the byte address
+// of the instruction. Branch targets are word addresses, as used by pasm, so that
+// the output may be reassembled. Words that are not valid instructions, or are
+// not encoded as the assembler would encode them, are shown as .codeword directives.
+func Decode(w uint32, addr uint) string {
+	s := decode(w, addr/4)
+	// Check that the instruction reassembles to the same word.
+	a := newAssembler(nil)
+	a.final = true
+	a.pc = int(addr / 4)
+	if err := a.line(s); err != nil || a.pc != int(addr/4)+1 || a.code[addr/4] != w {
+		return codeword(w)
+	}
+	return s
+}
+
+// decode disassembles the instruction word at the word address.
+func decode(w uint32, pc uint) string {
+	rd := int(w & 0xFF)
+	rs1 := int(w>>8) & 0xFF
+	switch w >> 29 {
+	case 0:
+		op := (w >> 25) & 0xF
+		switch {
+		case w == insNop:
+			return "NOP"
+		case op == aluOps["AND"] && (w&immFlag) == 0 && int(w>>16)&0xFF == rs1:
+			return fmt.Sprintf("MOV %s, %s", regName(rd), regName(rs1))
+		case op == aluOps["NOT"]:
+			return fmt.Sprintf("NOT %s, %s", regName(rd), regName(rs1))
+		}
+		return fmt.Sprintf("%s %s, %s, %s", name(aluOps, op), regName(rd), regName(rs1), op2Name(w))
+	case 1:
+		switch (w >> 25) & 0xF {
+		case 0:
+			return "JMP " + jumpTarget(w)
+		case 1:
+			return fmt.Sprintf("JAL %s, %s", regName(rd), jumpTarget(w))
+		case 2:
+			if (w & immFlag) == 0 {
+				return fmt.Sprintf("LDI %s, %s", regName(rd), immName((w>>8)&0xFFFF))
+			}
+		case 3:
+			return fmt.Sprintf("LMBD %s, %s, %s", regName(rd), regName(rs1), op2Name(w))
+		case 5:
+			if w == fmtHalt {
+				return "HALT"
+			}
+		case 7:
+			op := (w >> 23) & 3
+			switch {
+			case op == xfrOps["XIN"] && (w>>15)&0xFF == xfrZero:
+				return fmt.Sprintf("ZERO %s, %d", burstReg(rd), (w>>7)&0x7F+1)
+			case op == xfrOps["XIN"] && (w>>15)&0xFF == xfrFill:
+				return fmt.Sprintf("FILL %s, %d", burstReg(rd), (w>>7)&0x7F+1)
+			case op != 0:
+				return fmt.Sprintf("%s %d, %s, %d", name(xfrOps, op), (w>>15)&0xFF, burstReg(rd), (w>>7)&0x7F+1)
+			}
+		case 8:
+			op := "LOOP"
+			if (w & loopIntr) != 0 {
+				op = "ILOOP"
+			}
+			count := regName(int(w>>16) & 0xFF)
+			if (w & immFlag) != 0 {
+				count = fmt.Sprintf("%d", (w>>16)&0xFF+1)
+			}
+			return fmt.Sprintf("%s 0x%x, %s", op, (pc+uint(w&0xFF))&0xFFFF, count)
+		case 15:
+			if (w & wakeFlag) != 0 {
+				return "SLP 1"
+			}
+			return "SLP 0"
+		}
+	case 2, 3:
+		cond := (w >> 27) & 7
+		target := branchTarget(w, pc)
+		if cond == branchOps["QBA"] {
+			return "QBA " + target
+		}
+		if cond != 0 {
+			return fmt.Sprintf("%s %s, %s, %s", name(branchOps, cond), target, regName(rs1), op2Name(w))
+		}
+	case 4, 7:
+		op := "S"
+		if (w & loadFlag) != 0 {
+			op = "L"
+		}
+		var base string
+		if w>>29 == 4 {
+			op += "BCO"
+			base = fmt.Sprintf("c%d", rs1&0x1F)
+		} else {
+			op += "BBO"
+			base = fmt.Sprintf("r%d", rs1&0x1F)
+		}
+		l := (w>>25&7)<<4 | (w>>13&7)<<1 | (w>>7)&1
+		length := fmt.Sprintf("b%d", l-maxBurst)
+		if l < maxBurst {
+			length = fmt.Sprintf("%d", l+1)
+		}
+		return fmt.Sprintf("%s %s, %s, %s, %s", op, burstReg(rd), base, op2Name(w), length)
+	case 6:
+		var op string
+		switch w & (bitSet | bitClear) {
+		case bitSet:
+			op = "QBBS"
+		case bitClear:
+			op = "QBBC"
+		default:
+			return codeword(w)
+		}
+		if (w>>25)&3 == 0 && w&0xFF == 0 {
+			// Branch to self, so the wait pseudo instruction is used.
+			if op == "QBBC" {
+				return fmt.Sprintf("WBS %s, %s", regName(rs1), op2Name(w))
+			}
+			return fmt.Sprintf("WBC %s, %s", regName(rs1), op2Name(w))
+		}
+		return fmt.Sprintf("%s %s, %s, %s", op, branchTarget(w, pc), regName(rs1), op2Name(w))
+	}
+	return codeword(w)
+}
+
+// codeword returns an unknown instruction as a .codeword directive.
+func codeword(w uint32) string {
+	return fmt.Sprintf(".codeword 0x%08x", w)
+}
+
+// name returns the mnemonic for the opcode.
+func name(ops map[string]uint32, op uint32) string {
+	for n, v := range ops {
+		if v == op {
+			return n
+		}
+	}
+	return "?"
+}
+
+// regName returns the name of the register field e.g r4.w2
+func regName(f int) string {
+	r := reg{n: f & 0x1F, sel: f >> 5}
+	switch {
+	case r.sel < selW0:
+		return fmt.Sprintf("r%d.b%d", r.n, r.sel)
+	case r.sel < selFull:
+		return fmt.Sprintf("r%d.w%d", r.n, r.sel-selW0)
+	}
+	return fmt.Sprintf("r%d", r.n)
+}
+
+// burstReg returns the name of the first register of a load, store or transfer
+// e.g &r4.b2
+func burstReg(f int) string {
+	s := fmt.Sprintf("&r%d", f&0x1F)
+	if b := (f >> 5) & 3; b != 0 {
+		s += fmt.Sprintf(".b%d", b)
+	}
+	return s
+}
+
+// immName formats an immediate value.
+func immName(v uint32) string {
+	if v < 10 {
+		return fmt.Sprintf("%d", v)
+	}
+	return fmt.Sprintf("0x%x", v)
+}
+
+// op2Name returns the second operand, which is either a register or an immediate value.
+func op2Name(w uint32) string {
+	v := (w >> 16) & 0xFF
+	if (w & immFlag) != 0 {
+		return immName(v)
+	}
+	return regName(int(v))
+}
+
+// jumpTarget returns the target of JMP or JAL.
+func jumpTarget(w uint32) string {
+	if (w & immFlag) != 0 {
+		return fmt.Sprintf("0x%x", (w>>8)&0xFFFF)
+	}
+	return regName(int(w>>16) & 0xFF)
+}
+
+// branchTarget returns the word address of the target of a branch.
+func branchTarget(w uint32, pc uint) string {
+	offs := int((w>>25)&3<<8 | w&0xFF)
+	if offs >= 512 {
+		offs -= 1024
+	}
+	return fmt.Sprintf("0x%x", (int(pc)+offs)&0xFFFF)
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestDecodeExamples checks that every instruction in the binary files generated
+// by pasm for the example programs is disassembled, and reassembles to the same word.
+func TestDecodeExamples(t *testing.T) {
+	files, err := filepath.Glob("../examples/*/*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+4 <= len(b); i += 4 {
+			w := binary.LittleEndian.Uint32(b[i:])
+			if s := Decode(w, uint(i)); strings.HasPrefix(s, ".codeword") {
+				t.Errorf("%s: 0x%04x: %08x not decoded", f, i, w)
+			}
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	code := []uint32{0x240000e0, 0x6f00e8ff, 0x2a000001}
+	var b bytes.Buffer
+	if err := Listing(&b, code, 0x24); err != nil {
+		t.Fatal(err)
+	}
+	want := `0x0009: 0x240000e0  LDI r0, 0
+0x000a: 0x6f00e8ff  QBNE 0x9, r8, 0
+0x000b: 0x2a000001  .codeword 0x2a000001
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+	l := Disassemble(code, 0x24)
+	if want := (Inst{Addr: 0x28, Word: 0x6f00e8ff, Text: "QBNE 0x9, r8, 0"}); !reflect.DeepEqual(l[1], want) {
+		t.Errorf("got %+v, want %+v", l[1], want)
+	}
+}
+
+// TestDecodeInvalid checks that words that are not valid instructions,
+// or that are not encoded as the assembler would encode them, are shown as .codeword.
+func TestDecodeInvalid(t *testing.T) {
+	for _, w := range []uint32{
+		0x2a000001, // HALT with operand bits set
+		0x2e000000, // XFR with no operation
+		0x7f000000, // QBA with the register operand fields set
+		0x3c000000, // Unused format 2 opcode
+	} {
+		if s := Decode(w, 0); !strings.HasPrefix(s, ".codeword") {
+			t.Errorf("%08x: decoded as %q", w, s)
+		}
+	}
+}
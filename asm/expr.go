@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Binary operators, in increasing order of precedence.
+var precedence = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// expr is a parser for constant expressions, which
+// use C syntax and operator precedence.
+type expr struct {
+	a   *assembler
+	s   string
+	pos int
+}
+
+// eval evaluates the expression.
+func (a *assembler) eval(s string) (int64, error) {
+	e := &expr{a: a, s: s}
+	v, err := e.binary(0)
+	if err != nil {
+		return 0, err
+	}
+	e.skipSpace()
+	if e.pos != len(e.s) {
+		return 0, fmt.Errorf("invalid expression %q", s)
+	}
+	return v, nil
+}
+
+func (e *expr) skipSpace() {
+	for e.pos < len(e.s) && (e.s[e.pos] == ' ' || e.s[e.pos] == '\t') {
+		e.pos++
+	}
+}
+
+// match consumes the operator if it is next in the expression.
+func (e *expr) match(op string) bool {
+	e.skipSpace()
+	if !strings.HasPrefix(e.s[e.pos:], op) {
+		return false
+	}
+	// Avoid matching the first character of a 2 character operator.
+	if len(op) == 1 && e.pos+1 < len(e.s) {
+		next := e.s[e.pos+1]
+		if (op == "<" || op == ">") && next == op[0] {
+			return false
+		}
+	}
+	e.pos += len(op)
+	return true
+}
+
+// binary parses the binary operators at the precedence level.
+func (e *expr) binary(level int) (int64, error) {
+	if level == len(precedence) {
+		return e.unary()
+	}
+	v, err := e.binary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		var op string
+		for _, o := range precedence[level] {
+			if e.match(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return v, nil
+		}
+		r, err := e.binary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "|":
+			v |= r
+		case "^":
+			v ^= r
+		case "&":
+			v &= r
+		case "<<":
+			v <<= uint(r)
+		case ">>":
+			v >>= uint(r)
+		case "+":
+			v += r
+		case "-":
+			v -= r
+		case "*":
+			v *= r
+		case "/", "%":
+			if r == 0 {
+				return 0, fmt.Errorf("divide by zero in %q", e.s)
+			}
+			if op == "/" {
+				v /= r
+			} else {
+				v %= r
+			}
+		}
+	}
+}
+
+// unary parses the unary operators and primary expressions.
+func (e *expr) unary() (int64, error) {
+	switch {
+	case e.match("-"):
+		v, err := e.unary()
+		return -v, err
+	case e.match("+"):
+		return e.unary()
+	case e.match("~"):
+		v, err := e.unary()
+		return ^v, err
+	case e.match("!"):
+		v, err := e.unary()
+		if v == 0 {
+			return 1, err
+		}
+		return 0, err
+	case e.match("("):
+		v, err := e.binary(0)
+		if err != nil {
+			return 0, err
+		}
+		if !e.match(")") {
+			return 0, fmt.Errorf("missing ')' in %q", e.s)
+		}
+		return v, nil
+	}
+	e.skipSpace()
+	start := e.pos
+	if e.pos < len(e.s) && e.s[e.pos] == '\'' {
+		// Character constant.
+		if e.pos+2 < len(e.s) && e.s[e.pos+2] == '\'' {
+			e.pos += 3
+			return int64(e.s[start+1]), nil
+		}
+		return 0, fmt.Errorf("invalid character constant in %q", e.s)
+	}
+	for e.pos < len(e.s) && isIdent(e.s[e.pos]) {
+		e.pos++
+	}
+	tok := e.s[start:e.pos]
+	if tok == "" {
+		return 0, fmt.Errorf("invalid expression %q", e.s)
+	}
+	if tok[0] >= '0' && tok[0] <= '9' {
+		return parseNumber(tok)
+	}
+	// SIZE(struct) and OFFSET(struct.field)
+	if u := strings.ToUpper(tok); (u == "SIZE" || u == "OFFSET") && e.match("(") {
+		end := strings.IndexByte(e.s[e.pos:], ')')
+		if end < 0 {
+			return 0, fmt.Errorf("missing ')' in %q", e.s)
+		}
+		arg := strings.TrimSpace(e.s[e.pos : e.pos+end])
+		e.pos += end + 1
+		if u == "SIZE" {
+			return e.a.sizeOf(arg)
+		}
+		return e.a.offsetOf(arg)
+	}
+	return e.a.symbol(tok)
+}
+
+// parseNumber converts a decimal, hex (0x), binary (0b) or octal (leading 0) number.
+func parseNumber(tok string) (int64, error) {
+	v, err := strconv.ParseInt(tok, 0, 64)
+	if err != nil {
+		u, uerr := strconv.ParseUint(tok, 0, 64)
+		if uerr != nil {
+			return 0, fmt.Errorf("invalid number %q", tok)
+		}
+		v = int64(u)
+	}
+	return v, nil
+}
+
+// isIdent returns true if the character may be part of an identifier or number.
+func isIdent(c byte) bool {
+	return c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,778 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Register field selectors.
+const (
+	selB0   = 0
+	selW0   = 4
+	selFull = 7
+)
+
+// Arithmetic and logical opcodes.
+var aluOps = map[string]uint32{
+	"ADD": 0,
+	"ADC": 1,
+	"SUB": 2,
+	"SUC": 3,
+	"LSL": 4,
+	"LSR": 5,
+	"RSB": 6,
+	"RSC": 7,
+	"AND": 8,
+	"OR":  9,
+	"XOR": 10,
+	"NOT": 11,
+	"MIN": 12,
+	"MAX": 13,
+	"CLR": 14,
+	"SET": 15,
+}
+
+// Quick branch conditions.
+var branchOps = map[string]uint32{
+	"QBGT": 1,
+	"QBEQ": 2,
+	"QBGE": 3,
+	"QBLT": 4,
+	"QBNE": 5,
+	"QBLE": 6,
+	"QBA":  7,
+}
+
+// Register transfer (broadside) operations.
+var xfrOps = map[string]uint32{
+	"XIN":  1,
+	"XOUT": 2,
+	"XCHG": 3,
+}
+
+// Device IDs of the XIN instructions used for the ZERO and FILL pseudo instructions.
+const (
+	xfrFill = 0xFE
+	xfrZero = 0xFF
+)
+
+// Instruction formats and fixed encodings.
+const (
+	fmtAlu    = 0x00000000
+	fmtJmp    = 0x20000000
+	fmtJal    = 0x22000000
+	fmtLdi    = 0x24000000
+	fmtLmbd   = 0x26000000
+	fmtHalt   = 0x2A000000
+	fmtXfr    = 0x2E000000 // XIN/XOUT/XCHG
+	fmtLoop   = 0x30000000
+	fmtSlp    = 0x3E000000
+	fmtBranch = 0x40000000
+	fmtBitBr  = 0xC0000000
+	fmtBurst  = 0xE0000000 // LBBO/SBBO
+	fmtConst  = 0x80000000 // LBCO/SBCO
+	immFlag   = 0x01000000
+	loadFlag  = 0x10000000
+	wakeFlag  = 0x00800000
+	bitClear  = 0x08000000 // QBBC
+	bitSet    = 0x10000000 // QBBS
+	loopIntr  = 0x00008000 // ILOOP
+	insNop    = 0x12E0E0E0 // OR r0, r0, r0
+
+	maxBurst = 124 // Maximum immediate burst length
+)
+
+// reg is a register field, optionally with a bit number.
+type reg struct {
+	n   int // Register number
+	sel int // Field selector: 0-3 bytes, 4-6 words, 7 the full register
+	bit int // Bit number, or -1 if none
+}
+
+// field returns the encoded register field.
+func (r reg) field() uint32 {
+	return uint32(r.sel<<5 | r.n)
+}
+
+// offset returns the byte offset of the field in the register.
+func (r reg) offset() int {
+	switch {
+	case r.sel < selW0:
+		return r.sel
+	case r.sel < selFull:
+		return r.sel - selW0
+	}
+	return 0
+}
+
+// width returns the width of the field in bytes.
+func (r reg) width() int {
+	switch {
+	case r.sel < selW0:
+		return 1
+	case r.sel < selFull:
+		return 2
+	}
+	return 4
+}
+
+// fieldReg returns the register field at the byte offset in the register file.
+func fieldReg(addr, size int) (reg, error) {
+	r := reg{n: addr / 4, bit: -1}
+	offs := addr % 4
+	switch {
+	case size == 1:
+		r.sel = selB0 + offs
+	case size == 2 && offs <= 2:
+		r.sel = selW0 + offs
+	case size == 4 && offs == 0:
+		r.sel = selFull
+	default:
+		return r, fmt.Errorf("field at r%d.b%d is not aligned", r.n, offs)
+	}
+	return r, nil
+}
+
+// register parses a register operand e.g r4, r4.w1, r4.b3, r31.t30, or a field of a
+// structure that has been assigned to registers. If the operand is not a register,
+// false is returned.
+func (a *assembler) register(s string) (reg, bool, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "&")
+	name, suffix := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		name, suffix = s[:i], s[i:]
+	}
+	var r reg
+	if as, ok := a.assigns[name]; ok {
+		if suffix == "" {
+			size := as.def.size
+			if size > 4 {
+				size = 4
+			}
+			if as.base%4 != 0 {
+				size = 1
+			}
+			r, _ = fieldReg(as.base, size)
+		} else {
+			fname := suffix[1:]
+			suffix = ""
+			if i := strings.IndexByte(fname, '.'); i >= 0 {
+				fname, suffix = fname[:i], fname[i:]
+			}
+			f, ok := as.def.fields[fname]
+			if !ok {
+				return r, true, fmt.Errorf("unknown field %s.%s", name, fname)
+			}
+			var err error
+			if r, err = fieldReg(as.base+f.offset, f.size); err != nil {
+				return r, true, err
+			}
+		}
+	} else {
+		if len(name) < 2 || (name[0] != 'r' && name[0] != 'R') {
+			return r, false, nil
+		}
+		n, err := strconv.Atoi(name[1:])
+		if err != nil || name[1] < '0' || name[1] > '9' {
+			return r, false, nil
+		}
+		if n > 31 {
+			return r, true, fmt.Errorf("invalid register %s", name)
+		}
+		r = reg{n: n, sel: selFull, bit: -1}
+	}
+	for suffix != "" {
+		sub := suffix[1:]
+		suffix = ""
+		if i := strings.IndexByte(sub, '.'); i >= 0 {
+			sub, suffix = sub[:i], sub[i:]
+		}
+		if len(sub) < 2 || r.bit >= 0 {
+			return r, true, fmt.Errorf("invalid register %s", s)
+		}
+		v, err := strconv.Atoi(sub[1:])
+		if err != nil {
+			return r, true, fmt.Errorf("invalid register %s", s)
+		}
+		switch sub[0] {
+		case 'b', 'B':
+			if v >= r.width() {
+				return r, true, fmt.Errorf("invalid register %s", s)
+			}
+			r.sel = selB0 + r.offset() + v
+		case 'w', 'W':
+			if r.width() != 4 || v > 2 {
+				return r, true, fmt.Errorf("invalid register %s", s)
+			}
+			r.sel = selW0 + v
+		case 't', 'T':
+			if v >= r.width()*8 {
+				return r, true, fmt.Errorf("invalid register %s", s)
+			}
+			r.bit = v
+		default:
+			return r, true, fmt.Errorf("invalid register %s", s)
+		}
+	}
+	return r, true, nil
+}
+
+// mustReg parses an operand that must be a register field.
+func (a *assembler) mustReg(s string) (reg, error) {
+	r, ok, err := a.register(s)
+	if err != nil {
+		return r, err
+	}
+	if !ok {
+		return r, fmt.Errorf("%s is not a register", s)
+	}
+	if r.bit >= 0 {
+		return r, fmt.Errorf("bit not allowed in %s", s)
+	}
+	return r, nil
+}
+
+// value evaluates an immediate operand, checking that it is in range.
+func (a *assembler) value(s string, max int64) (uint32, error) {
+	v, err := a.eval(strings.TrimPrefix(s, "#"))
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 || v > max {
+		return 0, fmt.Errorf("value %d out of range (0 to %d)", v, max)
+	}
+	return uint32(v), nil
+}
+
+// op2 parses the second operand of an instruction, which may be a register
+// field or an immediate value, returning the encoded operand and
+// the immediate flag.
+func (a *assembler) op2(s string, max int64) (uint32, uint32, error) {
+	r, ok, err := a.register(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	if ok {
+		if r.bit >= 0 {
+			return 0, 0, fmt.Errorf("bit not allowed in %s", s)
+		}
+		return r.field(), 0, nil
+	}
+	v, err := a.value(s, max)
+	return v, immFlag, err
+}
+
+// target evaluates a branch target, returning the signed word offset from
+// the current instruction.
+func (a *assembler) target(s string) (uint32, error) {
+	v, err := a.eval(s)
+	if err != nil {
+		return 0, err
+	}
+	offs := v - int64(a.pc)
+	if a.final && (offs < -512 || offs > 511) {
+		return 0, fmt.Errorf("branch to %s out of range", s)
+	}
+	return uint32(offs) & 0x3FF, nil
+}
+
+// nargs checks the number of operands.
+func nargs(op string, args []string, n ...int) error {
+	for _, c := range n {
+		if len(args) == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("wrong number of operands for %s", op)
+}
+
+// instruction assembles one instruction.
+func (a *assembler) instruction(op string, args []string) error {
+	if code, ok := aluOps[op]; ok {
+		return a.alu(op, code, args)
+	}
+	if cond, ok := branchOps[op]; ok {
+		return a.branch(op, cond, args)
+	}
+	switch op {
+	case "MOV":
+		return a.mov(args)
+	case "LDI":
+		if err := nargs(op, args, 2); err != nil {
+			return err
+		}
+		rd, err := a.mustReg(args[0])
+		if err != nil {
+			return err
+		}
+		v, err := a.value(args[1], 0xFFFF)
+		if err != nil {
+			return err
+		}
+		return a.emit(fmtLdi | v<<8 | rd.field())
+	case "LMBD":
+		if err := nargs(op, args, 3); err != nil {
+			return err
+		}
+		rd, err := a.mustReg(args[0])
+		if err != nil {
+			return err
+		}
+		rs1, err := a.mustReg(args[1])
+		if err != nil {
+			return err
+		}
+		v, imm, err := a.op2(args[2], 0xFF)
+		if err != nil {
+			return err
+		}
+		return a.emit(fmtLmbd | imm | v<<16 | rs1.field()<<8 | rd.field())
+	case "JMP":
+		if err := nargs(op, args, 1); err != nil {
+			return err
+		}
+		return a.jump(0, args[0])
+	case "JAL":
+		if err := nargs(op, args, 2); err != nil {
+			return err
+		}
+		rd, err := a.mustReg(args[0])
+		if err != nil {
+			return err
+		}
+		return a.jump(fmtJal|rd.field(), args[1])
+	case "CALL":
+		if err := nargs(op, args, 1); err != nil {
+			return err
+		}
+		return a.jump(fmtJal|a.callReg.field(), args[0])
+	case "RET":
+		if err := nargs(op, args, 0); err != nil {
+			return err
+		}
+		return a.emit(fmtJmp | a.callReg.field()<<16)
+	case "HALT":
+		if err := nargs(op, args, 0); err != nil {
+			return err
+		}
+		return a.emit(fmtHalt)
+	case "NOP":
+		if err := nargs(op, args, 0); err != nil {
+			return err
+		}
+		return a.emit(insNop)
+	case "SLP":
+		if err := nargs(op, args, 1); err != nil {
+			return err
+		}
+		v, err := a.value(args[0], 1)
+		if err != nil {
+			return err
+		}
+		if v != 0 {
+			return a.emit(fmtSlp | wakeFlag)
+		}
+		return a.emit(fmtSlp)
+	case "QBBS", "QBBC":
+		return a.bitBranch(op, args)
+	case "WBS", "WBC":
+		// Wait for bit by branching to the same instruction
+		// while the bit is in the opposite state.
+		bop := "QBBC"
+		if op == "WBC" {
+			bop = "QBBS"
+		}
+		return a.bitBranch(bop, append([]string{strconv.Itoa(a.pc)}, args...))
+	case "LBBO", "SBBO", "LBCO", "SBCO":
+		return a.memory(op, args)
+	case "LOOP", "ILOOP":
+		return a.loop(op, args)
+	case "XIN", "XOUT", "XCHG":
+		return a.xfr(op, args)
+	case "ZERO":
+		return a.fill(op, args, xfrZero)
+	case "FILL":
+		return a.fill(op, args, xfrFill)
+	case "MVIB", "MVIW", "MVID", "SXIN", "SXOUT", "SXCHG", "SCAN", "LFC", "STC":
+		return fmt.Errorf("%s is not supported", op)
+	}
+	return fmt.Errorf("unknown instruction %s", op)
+}
+
+// alu assembles the arithmetic and logical instructions.
+func (a *assembler) alu(op string, code uint32, args []string) error {
+	var rd, rs1 reg
+	var v, imm uint32
+	var err error
+	switch {
+	case op == "NOT":
+		if err := nargs(op, args, 2); err != nil {
+			return err
+		}
+		if rd, err = a.mustReg(args[0]); err != nil {
+			return err
+		}
+		if rs1, err = a.mustReg(args[1]); err != nil {
+			return err
+		}
+	case op == "CLR" || op == "SET":
+		// CLR/SET forms are:
+		//	CLR Rd, Rs, bit
+		//	CLR Rd, bit
+		//	CLR Rd, Rs.tN
+		//	CLR Rd.tN
+		if err := nargs(op, args, 1, 2, 3); err != nil {
+			return err
+		}
+		r, ok, err := a.register(args[len(args)-1])
+		if err != nil {
+			return err
+		}
+		if ok && r.bit >= 0 {
+			v, imm = uint32(r.bit), immFlag
+			r.bit = -1
+			rs1 = r
+			if len(args) == 3 {
+				return fmt.Errorf("wrong number of operands for %s", op)
+			}
+			rd = r
+			if len(args) == 2 {
+				if rd, err = a.mustReg(args[0]); err != nil {
+					return err
+				}
+			}
+		} else {
+			if len(args) == 1 {
+				return fmt.Errorf("%s requires a bit number", op)
+			}
+			if rd, err = a.mustReg(args[0]); err != nil {
+				return err
+			}
+			rs1 = rd
+			if len(args) == 3 {
+				if rs1, err = a.mustReg(args[1]); err != nil {
+					return err
+				}
+			}
+			if v, imm, err = a.op2(args[len(args)-1], 31); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := nargs(op, args, 3); err != nil {
+			return err
+		}
+		if rd, err = a.mustReg(args[0]); err != nil {
+			return err
+		}
+		if rs1, err = a.mustReg(args[1]); err != nil {
+			return err
+		}
+		if v, imm, err = a.op2(args[2], 0xFF); err != nil {
+			return err
+		}
+	}
+	return a.emit(fmtAlu | code<<25 | imm | v<<16 | rs1.field()<<8 | rd.field())
+}
+
+// mov assembles the MOV pseudo instruction, which uses AND to move a register,
+// and LDI to load an immediate value. A 32 bit register loaded with a value larger than
+// 16 bits requires 2 LDI instructions.
+func (a *assembler) mov(args []string) error {
+	if err := nargs("MOV", args, 2); err != nil {
+		return err
+	}
+	rd, err := a.mustReg(args[0])
+	if err != nil {
+		return err
+	}
+	rs, ok, err := a.register(args[1])
+	if err != nil {
+		return err
+	}
+	if ok {
+		if rs.bit >= 0 {
+			return fmt.Errorf("bit not allowed in %s", args[1])
+		}
+		return a.emit(fmtAlu | aluOps["AND"]<<25 | rs.field()<<16 | rs.field()<<8 | rd.field())
+	}
+	v, err := a.eval(strings.TrimPrefix(args[1], "#"))
+	if err != nil {
+		return err
+	}
+	bits := uint(rd.width() * 8)
+	if v < -(1<<(bits-1)) || v >= 1<<bits {
+		return fmt.Errorf("value %d too large for %s", v, args[0])
+	}
+	w := uint32(v) & uint32(1<<bits-1)
+	if w <= 0xFFFF {
+		return a.emit(fmtLdi | w<<8 | rd.field())
+	}
+	if err := a.emit(fmtLdi | (w&0xFFFF)<<8 | uint32(selW0<<5|rd.n)); err != nil {
+		return err
+	}
+	return a.emit(fmtLdi | (w>>16)<<8 | uint32((selW0+2)<<5|rd.n))
+}
+
+// jump assembles JMP and JAL, where the target is a register or an address.
+func (a *assembler) jump(ins uint32, s string) error {
+	if ins == 0 {
+		ins = fmtJmp
+	}
+	r, ok, err := a.register(s)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if r.bit >= 0 {
+			return fmt.Errorf("bit not allowed in %s", s)
+		}
+		return a.emit(ins | r.field()<<16)
+	}
+	v, err := a.value(s, 0xFFFF)
+	if err != nil {
+		return err
+	}
+	return a.emit(ins | immFlag | v<<8)
+}
+
+// branch assembles the quick branch instructions.
+func (a *assembler) branch(op string, cond uint32, args []string) error {
+	var rs1 reg
+	var v, imm uint32
+	var err error
+	if op == "QBA" {
+		if err := nargs(op, args, 1); err != nil {
+			return err
+		}
+		imm = immFlag
+	} else {
+		if err := nargs(op, args, 3); err != nil {
+			return err
+		}
+		if rs1, err = a.mustReg(args[1]); err != nil {
+			return err
+		}
+		if v, imm, err = a.op2(args[2], 0xFF); err != nil {
+			return err
+		}
+	}
+	offs, err := a.target(args[0])
+	if err != nil {
+		return err
+	}
+	return a.emit(fmtBranch | cond<<27 | (offs>>8)<<25 | imm | v<<16 | rs1.field()<<8 | offs&0xFF)
+}
+
+// bitBranch assembles QBBS and QBBC, where the bit is specified as an operand
+// or as part of the register (e.g r31.t30).
+func (a *assembler) bitBranch(op string, args []string) error {
+	if err := nargs(op, args, 2, 3); err != nil {
+		return err
+	}
+	rs1, ok, err := a.register(args[1])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not a register", args[1])
+	}
+	var v, imm uint32
+	if len(args) == 2 {
+		if rs1.bit < 0 {
+			return fmt.Errorf("%s requires a bit number", op)
+		}
+		v, imm = uint32(rs1.bit), immFlag
+	} else {
+		if rs1.bit >= 0 {
+			return fmt.Errorf("bit not allowed in %s", args[1])
+		}
+		if v, imm, err = a.op2(args[2], 31); err != nil {
+			return err
+		}
+	}
+	offs, err := a.target(args[0])
+	if err != nil {
+		return err
+	}
+	ins := uint32(fmtBitBr | bitSet)
+	if op == "QBBC" {
+		ins = fmtBitBr | bitClear
+	}
+	return a.emit(ins | (offs>>8)<<25 | imm | v<<16 | rs1.field()<<8 | offs&0xFF)
+}
+
+// memory assembles the load and store instructions, of the forms:
+//
+//	LBBO &Rd, Rb, offset, length
+//	LBCO &Rd, Cn, offset, length
+//
+// where offset is a register or an immediate value, and the length
+// is an immediate value or b0-b3, to use the length in r0.b0-r0.b3.
+func (a *assembler) memory(op string, args []string) error {
+	if err := nargs(op, args, 4); err != nil {
+		return err
+	}
+	rd, err := a.mustReg(args[0])
+	if err != nil {
+		return err
+	}
+	ins := uint32(fmtBurst)
+	if op[2] == 'C' {
+		ins = fmtConst
+	}
+	if op[0] == 'L' {
+		ins |= loadFlag
+	}
+	var rb uint32
+	if op[2] == 'C' {
+		c := strings.TrimSpace(args[1])
+		if len(c) > 1 && (c[0] == 'c' || c[0] == 'C') && c[1] >= '0' && c[1] <= '9' {
+			c = c[1:]
+		}
+		if rb, err = a.value(c, 31); err != nil {
+			return err
+		}
+	} else {
+		r, err := a.mustReg(args[1])
+		if err != nil {
+			return err
+		}
+		if r.sel != selFull {
+			return fmt.Errorf("base register %s must be a 32 bit register", args[1])
+		}
+		rb = uint32(r.n)
+	}
+	v, imm, err := a.op2(args[2], 0xFF)
+	if err != nil {
+		return err
+	}
+	var l uint32
+	switch n := strings.TrimSpace(args[3]); strings.ToLower(n) {
+	case "b0", "b1", "b2", "b3":
+		l = maxBurst + uint32(n[1]-'0')
+	default:
+		if l, err = a.value(n, maxBurst); err != nil {
+			return err
+		}
+		if l == 0 {
+			return fmt.Errorf("burst length must be at least 1")
+		}
+		l--
+	}
+	return a.emit(ins | (l>>4)<<25 | imm | v<<16 | ((l>>1)&7)<<13 | rb<<8 | (l&1)<<7 | uint32(rd.offset()<<5|rd.n))
+}
+
+// loop assembles LOOP and ILOOP, of the form:
+//
+//	LOOP label, count
+//
+// where label is the end of the loop (the instruction following the
+// last instruction of the loop), and count is a register or an immediate value from 1 to 256.
+func (a *assembler) loop(op string, args []string) error {
+	if err := nargs(op, args, 2); err != nil {
+		return err
+	}
+	end, err := a.eval(args[0])
+	if err != nil {
+		return err
+	}
+	offs := end - int64(a.pc)
+	if a.final && (offs < 2 || offs > 0xFF) {
+		return fmt.Errorf("loop end %s out of range", args[0])
+	}
+	ins := uint32(fmtLoop)
+	if op == "ILOOP" {
+		ins |= loopIntr
+	}
+	r, ok, err := a.register(args[1])
+	if err != nil {
+		return err
+	}
+	if ok {
+		if r.bit >= 0 {
+			return fmt.Errorf("bit not allowed in %s", args[1])
+		}
+		ins |= r.field() << 16
+	} else {
+		n, err := a.value(args[1], 256)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("loop count must be at least 1")
+		}
+		ins |= immFlag | (n-1)<<16
+	}
+	return a.emit(ins | uint32(offs)&0xFF)
+}
+
+// xfr assembles the register transfer instructions, of the form:
+//
+//	XIN id, &Rd, length
+//
+// where id is the device ID (e.g 10 for scratch pad bank 0), and length is
+// an immediate value.
+func (a *assembler) xfr(op string, args []string) error {
+	if err := nargs(op, args, 3); err != nil {
+		return err
+	}
+	id, err := a.value(args[0], 0xFF)
+	if err != nil {
+		return err
+	}
+	rd, err := a.mustReg(args[1])
+	if err != nil {
+		return err
+	}
+	l, err := a.value(args[2], maxBurst)
+	if err != nil {
+		return err
+	}
+	if l == 0 {
+		return fmt.Errorf("transfer length must be at least 1")
+	}
+	return a.emit(fmtXfr | xfrOps[op]<<23 | id<<15 | (l-1)<<7 | uint32(rd.offset()<<5|rd.n))
+}
+
+// fill assembles the ZERO and FILL pseudo instructions, which are encoded
+// as XIN from the device ID that clears or sets the bytes of the registers, e.g
+//
+//	ZERO &r5, 8
+//
+// clears r5 and r6.
+func (a *assembler) fill(op string, args []string, id uint32) error {
+	if err := nargs(op, args, 2); err != nil {
+		return err
+	}
+	rd, err := a.mustReg(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := a.value(args[1], maxBurst)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s length must be at least 1", op)
+	}
+	if rd.n*4+rd.offset()+int(n) > 32*4 {
+		return fmt.Errorf("%s exceeds register file", op)
+	}
+	return a.emit(fmtXfr | xfrOps["XIN"]<<23 | id<<15 | (n-1)<<7 | uint32(rd.offset()<<5|rd.n))
+}
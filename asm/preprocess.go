@@ -0,0 +1,435 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// macro is a macro defined using .macro
+type macro struct {
+	name     string
+	params   []string
+	defaults []string
+	body     []srcLine
+}
+
+// structDef is a structure defined using .struct
+type structDef struct {
+	name   string
+	size   int
+	fields map[string]*field
+}
+
+// field is a member of a structure.
+type field struct {
+	offset int
+	size   int
+}
+
+// assign maps a structure to registers, as defined using .assign
+type assign struct {
+	def  *structDef
+	base int // Byte offset of the structure in the register file.
+}
+
+// preprocess reads the source, removing comments and processing the
+// preprocessor commands, defines, macros and structures. The remaining
+// lines are saved for assembly.
+func (a *assembler) preprocess(file string, src []byte, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%s: includes nested too deeply", file)
+	}
+	inComment := false
+	for n, l := range strings.Split(string(src), "\n") {
+		var s string
+		s, inComment = stripComments(l, inComment)
+		if err := a.source(srcLine{file, n + 1, s}, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripComments removes comments from the line. inComment is true
+// if the line starts within a '/* ... */' comment.
+func stripComments(l string, inComment bool) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(l); i++ {
+		if inComment {
+			if strings.HasPrefix(l[i:], "*/") {
+				inComment = false
+				i++
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(l[i:], "/*"):
+			inComment = true
+			b.WriteByte(' ')
+			i++
+		case strings.HasPrefix(l[i:], "//"), l[i] == ';':
+			return strings.TrimSpace(b.String()), false
+		case l[i] == '\'' && i+2 < len(l) && l[i+2] == '\'':
+			// Copy character constants so that quoted ';' is not a comment.
+			b.WriteString(l[i : i+3])
+			i += 2
+		default:
+			b.WriteByte(l[i])
+		}
+	}
+	return strings.TrimSpace(b.String()), inComment
+}
+
+// source processes one line of source.
+func (a *assembler) source(l srcLine, depth int) error {
+	s := l.text
+	if s == "" {
+		return nil
+	}
+	if a.defMacro != nil {
+		// Save lines until the end of the macro.
+		op, args := splitOp(s)
+		switch strings.ToLower(op) {
+		case ".endm":
+			a.macros[a.defMacro.name] = a.defMacro
+			a.defMacro = nil
+		case ".mparam":
+			for _, p := range args {
+				def := ""
+				if i := strings.IndexByte(p, '='); i >= 0 {
+					def = strings.TrimSpace(p[i+1:])
+					p = strings.TrimSpace(p[:i])
+				}
+				a.defMacro.params = append(a.defMacro.params, p)
+				a.defMacro.defaults = append(a.defMacro.defaults, def)
+			}
+		default:
+			a.defMacro.body = append(a.defMacro.body, l)
+		}
+		return nil
+	}
+	if s[0] == '#' {
+		if err := a.command(l, depth); err != nil {
+			return fmt.Errorf("%s:%d: %v", l.file, l.line, err)
+		}
+		return nil
+	}
+	if a.inactive != 0 {
+		return nil
+	}
+	s, err := a.substitute(s, 0)
+	if err != nil {
+		return fmt.Errorf("%s:%d: %v", l.file, l.line, err)
+	}
+	labels, rest := splitLabels(s)
+	op, args := splitOp(rest)
+	if m, ok := a.macros[op]; ok {
+		if len(labels) != 0 {
+			a.lines = append(a.lines, srcLine{l.file, l.line, strings.Join(labels, ": ") + ":"})
+		}
+		if err := a.expand(m, args, l, depth); err != nil {
+			return fmt.Errorf("%s:%d: %v", l.file, l.line, err)
+		}
+		return nil
+	}
+	if lop := strings.ToLower(op); len(labels) == 0 && isDeclaration(lop) {
+		if err := a.declaration(lop, args); err != nil {
+			return fmt.Errorf("%s:%d: %v", l.file, l.line, err)
+		}
+		return nil
+	}
+	if a.defStr != nil {
+		return fmt.Errorf("%s:%d: only fields allowed in .struct", l.file, l.line)
+	}
+	a.lines = append(a.lines, srcLine{l.file, l.line, s})
+	return nil
+}
+
+// command processes the preprocessor commands.
+func (a *assembler) command(l srcLine, depth int) error {
+	op, rest := l.text, ""
+	if i := strings.IndexAny(l.text, " \t"); i >= 0 {
+		op, rest = l.text[:i], strings.TrimSpace(l.text[i+1:])
+	}
+	name := rest
+	if i := strings.IndexAny(rest, " \t"); i >= 0 {
+		name = rest[:i]
+	}
+	switch op {
+	case "#ifdef", "#ifndef":
+		_, ok := a.defines[name]
+		c := ok == (op == "#ifdef")
+		a.cond = append(a.cond, c)
+		if !c {
+			a.inactive++
+		}
+		return nil
+	case "#else":
+		if len(a.cond) == 0 {
+			return fmt.Errorf("#else without #ifdef")
+		}
+		c := &a.cond[len(a.cond)-1]
+		if *c {
+			a.inactive++
+		} else {
+			a.inactive--
+		}
+		*c = !*c
+		return nil
+	case "#endif":
+		if len(a.cond) == 0 {
+			return fmt.Errorf("#endif without #ifdef")
+		}
+		if !a.cond[len(a.cond)-1] {
+			a.inactive--
+		}
+		a.cond = a.cond[:len(a.cond)-1]
+		return nil
+	}
+	if a.inactive != 0 {
+		return nil
+	}
+	switch op {
+	case "#define":
+		if name == "" {
+			return fmt.Errorf("#define requires a name")
+		}
+		a.defines[name] = strings.TrimSpace(rest[len(name):])
+	case "#undef":
+		delete(a.defines, name)
+	case "#include":
+		if len(rest) < 2 || !(rest[0] == '"' && rest[len(rest)-1] == '"' || rest[0] == '<' && rest[len(rest)-1] == '>') {
+			return fmt.Errorf("#include requires a quoted file name")
+		}
+		f := includePath(l.file, rest[1:len(rest)-1])
+		src, err := a.open(f)
+		if err != nil {
+			return err
+		}
+		return a.preprocess(f, src, depth+1)
+	case "#error":
+		return fmt.Errorf("#error %s", rest)
+	default:
+		return fmt.Errorf("unknown preprocessor command %s", op)
+	}
+	return nil
+}
+
+// substitute replaces the defined names in the line with their values.
+func (a *assembler) substitute(s string, depth int) (string, error) {
+	if depth > maxDepth {
+		return "", fmt.Errorf("#define nested too deeply")
+	}
+	var b strings.Builder
+	changed := false
+	for i := 0; i < len(s); {
+		c := s[i]
+		if !isIdent(c) || c == '.' {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && isIdent(s[j]) && s[j] != '.' {
+			j++
+		}
+		tok := s[i:j]
+		if v, ok := a.defines[tok]; ok && (c < '0' || c > '9') {
+			b.WriteString(v)
+			changed = true
+		} else {
+			b.WriteString(tok)
+		}
+		i = j
+	}
+	if !changed {
+		return s, nil
+	}
+	return a.substitute(b.String(), depth+1)
+}
+
+// expand replaces the macro parameters with the arguments and
+// processes the lines of the macro.
+func (a *assembler) expand(m *macro, args []string, l srcLine, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("macro %s nested too deeply", m.name)
+	}
+	if len(args) > len(m.params) {
+		return fmt.Errorf("too many arguments for macro %s", m.name)
+	}
+	vals := make(map[string]string)
+	for i, p := range m.params {
+		v := m.defaults[i]
+		if i < len(args) && args[i] != "" {
+			v = args[i]
+		}
+		if v == "" {
+			return fmt.Errorf("missing argument %s for macro %s", p, m.name)
+		}
+		vals[p] = v
+	}
+	for _, ml := range m.body {
+		var b strings.Builder
+		s := ml.text
+		for i := 0; i < len(s); {
+			if !isIdent(s[i]) || s[i] == '.' {
+				b.WriteByte(s[i])
+				i++
+				continue
+			}
+			j := i
+			for j < len(s) && isIdent(s[j]) && s[j] != '.' {
+				j++
+			}
+			if v, ok := vals[s[i:j]]; ok {
+				b.WriteString(v)
+			} else {
+				b.WriteString(s[i:j])
+			}
+			i = j
+		}
+		// Errors are reported at the line invoking the macro.
+		if err := a.source(srcLine{l.file, l.line, b.String()}, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDeclaration returns true if the directive is processed by the preprocessor.
+func isDeclaration(op string) bool {
+	switch op {
+	case ".macro", ".struct", ".ends", ".u8", ".u16", ".u32", ".assign":
+		return true
+	}
+	return false
+}
+
+// declaration processes the directives declaring macros and structures.
+func (a *assembler) declaration(op string, args []string) error {
+	switch op {
+	case ".macro":
+		if len(args) != 1 {
+			return fmt.Errorf(".macro requires a name")
+		}
+		a.defMacro = &macro{name: args[0]}
+	case ".struct":
+		if len(args) != 1 {
+			return fmt.Errorf(".struct requires a name")
+		}
+		if a.defStr != nil {
+			return fmt.Errorf("nested .struct")
+		}
+		a.defStr = &structDef{name: args[0], fields: make(map[string]*field)}
+	case ".u8", ".u16", ".u32":
+		if a.defStr == nil {
+			return fmt.Errorf("%s outside of .struct", op)
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires a name", op)
+		}
+		size := map[string]int{".u8": 1, ".u16": 2, ".u32": 4}[op]
+		if _, ok := a.defStr.fields[args[0]]; ok {
+			return fmt.Errorf("field %s redefined", args[0])
+		}
+		a.defStr.fields[args[0]] = &field{offset: a.defStr.size, size: size}
+		a.defStr.size += size
+	case ".ends":
+		if a.defStr == nil {
+			return fmt.Errorf(".ends without .struct")
+		}
+		a.structs[a.defStr.name] = a.defStr
+		a.defStr = nil
+	case ".assign":
+		return a.assign(args)
+	}
+	return nil
+}
+
+// assign maps a structure to a range of registers, so that fields
+// of the structure may be used as register operands e.g
+//
+//	.assign Params, r4, r6, p
+//	MOV p.count, 0
+//
+// The end register may be '*' to use as many registers as required.
+func (a *assembler) assign(args []string) error {
+	if len(args) != 4 {
+		return fmt.Errorf(".assign requires struct, start register, end register and name")
+	}
+	def, ok := a.structs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown struct %s", args[0])
+	}
+	start, ok, err := a.register(args[1])
+	if err != nil || !ok {
+		return fmt.Errorf("invalid start register %s", args[1])
+	}
+	base := start.n*4 + start.offset()
+	end := base + def.size - 1
+	if args[2] != "*" {
+		r, ok, err := a.register(args[2])
+		if err != nil || !ok {
+			return fmt.Errorf("invalid end register %s", args[2])
+		}
+		if r.n*4+r.offset()+r.width()-1 != end {
+			return fmt.Errorf("register range does not match size of struct %s", def.name)
+		}
+	}
+	if end >= 32*4 {
+		return fmt.Errorf("struct %s exceeds register file", def.name)
+	}
+	for _, f := range def.fields {
+		if _, err := fieldReg(base+f.offset, f.size); err != nil {
+			return fmt.Errorf("%s: %v", def.name, err)
+		}
+	}
+	a.assigns[args[3]] = &assign{def: def, base: base}
+	return nil
+}
+
+// sizeOf returns the size of a structure.
+func (a *assembler) sizeOf(s string) (int64, error) {
+	if d, ok := a.structs[s]; ok {
+		return int64(d.size), nil
+	}
+	if as, ok := a.assigns[s]; ok {
+		return int64(as.def.size), nil
+	}
+	return 0, fmt.Errorf("unknown struct %s", s)
+}
+
+// offsetOf returns the offset of a field in a structure.
+func (a *assembler) offsetOf(s string) (int64, error) {
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return 0, fmt.Errorf("OFFSET requires struct.field")
+	}
+	d, ok := a.structs[s[:i]]
+	if !ok {
+		as, ok := a.assigns[s[:i]]
+		if !ok {
+			return 0, fmt.Errorf("unknown struct %s", s[:i])
+		}
+		d = as.def
+	}
+	f, ok := d.fields[s[i+1:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown field %s", s)
+	}
+	return int64(f.offset), nil
+}
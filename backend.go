@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Backend provides access to the memory and interrupt devices of
+// the PRU-ICSS subsystem. The default backend used by Open maps the
+// UIO device; alternative backends (such as a simulator) may be
+// passed to OpenWithBackend.
+type Backend interface {
+	// Memory returns the byte slice covering the PRU-ICSS address space.
+	// The PRU and unit RAM fields are slices of this memory.
+	Memory() []byte
+	// Load reads the 32 bit word at the byte offset.
+	Load(offs uintptr) uint32
+	// Store writes the 32 bit word at the byte offset.
+	Store(offs uintptr, v uint32)
+	// Signal opens the device that delivers the interrupts for the
+	// signal (host interrupt - 2). Each read of the device returns a 4 byte
+	// interrupt count when the host interrupt is raised, and the interrupt
+	// is re-enabled by writing a 4 byte value of 1 to the device.
+	// On Linux, devices that support epoll are read by a single goroutine;
+	// other devices are read by a separate goroutine for each device, and
+	// no value is written to re-enable the interrupt.
+	Signal(sig int) (*os.File, error)
+	// Close releases the resources held by the backend.
+	Close() error
+}
+
+// uioBackend accesses the PRU-ICSS via the memory mapped UIO device.
+type uioBackend struct {
+	f    *os.File
+	root string
+	devs [nSignals]int // UIO device number for each signal
+	mem  []byte
+}
+
+// newUioBackend discovers the UIO devices under the root directory,
+// and maps the PRU-ICSS memory.
+func newUioBackend(root string) (*uioBackend, error) {
+	b := &uioBackend{root: root, devs: findUio(root)}
+	memSize, err := readDriverValue(filepath.Join(root, fmt.Sprintf(drvMemSize, b.devs[0])))
+	if err != nil {
+		return nil, err
+	}
+	dev := filepath.Join(root, fmt.Sprintf(drvUioBase, b.devs[0]))
+	b.f, err = os.OpenFile(dev, os.O_RDWR|os.O_SYNC, 0660)
+	if err != nil {
+		return nil, err
+	}
+	b.mem, err = unix.Mmap(int(b.f.Fd()), 0, memSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		b.f.Close()
+		return nil, fmt.Errorf("%s: %v", dev, err)
+	}
+	return b, nil
+}
+
+// findUio scans the UIO devices under the root directory for the
+// PRU-ICSS event devices (named pruss_evt0 to pruss_evt7), returning the UIO
+// device number for each signal. Since other UIO devices may be present, the
+// numbering of the PRU-ICSS UIO devices may not start at 0.
+// If the devices are not found, the signals are assumed to be
+// mapped to /dev/uio0 to /dev/uio7.
+func findUio(root string) [nSignals]int {
+	var devs [nSignals]int
+	for i := range devs {
+		devs[i] = i
+	}
+	dirs, _ := filepath.Glob(filepath.Join(root, drvUioClass, "uio*"))
+	var found [nSignals]bool
+	for _, d := range dirs {
+		var n, sig int
+		if c, _ := fmt.Sscanf(filepath.Base(d), "uio%d", &n); c != 1 {
+			continue
+		}
+		name, err := os.ReadFile(filepath.Join(d, "name"))
+		if err != nil {
+			continue
+		}
+		if c, _ := fmt.Sscanf(strings.TrimSpace(string(name)), drvUioName, &sig); c != 1 || sig < 0 || sig >= nSignals {
+			continue
+		}
+		devs[sig] = n
+		found[sig] = true
+	}
+	for i := range devs {
+		if !found[i] {
+			// Use default numbering if any device is missing.
+			for j := range devs {
+				devs[j] = j
+			}
+			break
+		}
+	}
+	return devs
+}
+
+// Memory returns the mapped PRU-ICSS memory.
+func (b *uioBackend) Memory() []byte {
+	return b.mem
+}
+
+// Load reads one 32 bit word from the mapped memory.
+func (b *uioBackend) Load(offs uintptr) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&b.mem[offs])))
+}
+
+// Store writes one 32 bit word to the mapped memory.
+func (b *uioBackend) Store(offs uintptr, v uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&b.mem[offs])), v)
+}
+
+// Signal opens the UIO event device for the signal.
+func (b *uioBackend) Signal(sig int) (*os.File, error) {
+	return os.OpenFile(filepath.Join(b.root, fmt.Sprintf(drvUioBase, b.devs[sig])), os.O_RDWR|os.O_SYNC, 0660)
+}
+
+// Close unmaps the memory and closes the UIO device.
+func (b *uioBackend) Close() error {
+	unix.Munmap(b.mem)
+	return b.f.Close()
+}
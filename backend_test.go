@@ -0,0 +1,148 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Size of the PRU-ICSS memory map of the fake UIO devices.
+const testUioSize = 0x80000
+
+// uioRoot creates a fake UIO device tree in a temporary directory, with the
+// PRU-ICSS event devices starting at /dev/uio<first>. The first device is a
+// file containing the PRU-ICSS memory.
+func uioRoot(t *testing.T, first int) string {
+	t.Helper()
+	d := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(d, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < nSignals; i++ {
+		uio := fmt.Sprintf("uio%d", i+first)
+		writeUio(t, d, uio, map[string]string{
+			"name":           fmt.Sprintf("pruss_evt%d\n", i),
+			"maps/map0/addr": "0x4a300000\n",
+			"maps/map0/size": fmt.Sprintf("%#x\n", testUioSize),
+		})
+		var b []byte
+		if i == 0 {
+			// Set the interrupt controller revision to an AM33xx.
+			b = make([]byte, testUioSize)
+			binary.LittleEndian.PutUint32(b[rREVID:], 0x4E82A900)
+		}
+		if err := os.WriteFile(filepath.Join(d, "dev", uio), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+// writeUio writes the sysfs files of the UIO device.
+func writeUio(t *testing.T, root, uio string, files map[string]string) {
+	t.Helper()
+	dir := filepath.Join(root, drvUioClass, uio)
+	for name, v := range files {
+		f := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRoot opens the PRU via a fake UIO device tree in a temporary directory.
+func TestRoot(t *testing.T) {
+	// Add an offset to check that the devices are discovered by name.
+	d := uioRoot(t, 3)
+	p, err := Open(NewConfig().Root(d).EnableUnit(0).Event2Channel(18, 2).Channel2Interrupt(2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if desc := p.Description(); !strings.Contains(desc, "AM33xx") {
+		t.Errorf("description: got %q", desc)
+	}
+	if p.Unit(0) == nil || p.Unit(1) != nil {
+		t.Errorf("enabled units not configured correctly")
+	}
+	if p.Event(18) == nil || p.Event(19) != nil {
+		t.Errorf("events not configured correctly")
+	}
+}
+
+func TestFindUio(t *testing.T) {
+	d := uioRoot(t, 2)
+	// Other devices, and devices with invalid names, are ignored.
+	writeUio(t, d, "uio0", map[string]string{"name": "other\n"})
+	writeUio(t, d, "uio1", map[string]string{"name": "pruss_evt9\n"})
+	writeUio(t, d, "uio20", map[string]string{"name": "pruss_evtx\n"})
+	writeUio(t, d, "uiox", map[string]string{"name": "pruss_evt0\n"})
+	if got, want := findUio(d), [nSignals]int{2, 3, 4, 5, 6, 7, 8, 9}; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The default numbering is used if any device is missing.
+	if err := os.RemoveAll(filepath.Join(d, drvUioClass, "uio5")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := findUio(d), [nSignals]int{0, 1, 2, 3, 4, 5, 6, 7}; got != want {
+		t.Errorf("missing device: got %v, want %v", got, want)
+	}
+}
+
+func TestRootInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, d string)
+	}{
+		{"no devices", func(t *testing.T, d string) {
+			if err := os.RemoveAll(d); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"bad size", func(t *testing.T, d string) {
+			writeUio(t, d, "uio0", map[string]string{"maps/map0/size": "size\n"})
+		}},
+		{"empty size", func(t *testing.T, d string) {
+			writeUio(t, d, "uio0", map[string]string{"maps/map0/size": ""})
+		}},
+		{"no memory device", func(t *testing.T, d string) {
+			if err := os.Remove(filepath.Join(d, "dev/uio0")); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"not a PRU-ICSS", func(t *testing.T, d string) {
+			if err := os.WriteFile(filepath.Join(d, "dev/uio0"), make([]byte, testUioSize), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tc := range tests {
+		d := uioRoot(t, 0)
+		tc.setup(t, d)
+		p, err := Open(NewConfig().Root(d))
+		if err == nil {
+			p.Close()
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// img2go converts an image file generated by pasm (using the -m option)
+// to Go source code containing the program as a []uint32 variable e.g
+//
+//	//go:generate go run github.com/aamcrae/pru/cmd/pasm -m prucode.p prucode
+//	//go:generate go run github.com/aamcrae/pru/cmd/img2go prucode.img
+//
+// reads prucode.img and creates prucode_img.go, declaring the variable prucode_img.
+// If the package name is not specified, the package being generated
+// ($GOPACKAGE) is used, or the name of the current directory.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aamcrae/pru"
+)
+
+var pkg = flag.String("pkg", "", "Package name of the generated file")
+var varName = flag.String("var", "", "Variable name (default is <name>_img)")
+var output = flag.String("o", "", "Output file (default is <name>_img.go)")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file[.img]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	in := flag.Arg(0)
+	if filepath.Ext(in) != ".img" {
+		in += ".img"
+	}
+	name := strings.TrimSuffix(filepath.Base(in), ".img")
+	if *varName == "" {
+		*varName = name + "_img"
+	}
+	if *output == "" {
+		*output = strings.TrimSuffix(in, ".img") + "_img.go"
+	}
+	if *pkg == "" {
+		*pkg = os.Getenv("GOPACKAGE")
+	}
+	if *pkg == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		*pkg = filepath.Base(wd)
+	}
+	code, err := pru.ReadImgFile(in)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	src, err := generate(filepath.Base(in), *pkg, *varName, code)
+	if err != nil {
+		log.Fatalf("%s: %v", *output, err)
+	}
+	if err := os.WriteFile(*output, src, 0644); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// generate returns the formatted Go source declaring the program
+// as the variable in the package.
+func generate(img, pkg, varName string, code []uint32) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by img2go from %s. DO NOT EDIT.\n\n", img)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	fmt.Fprintf(&b, "var %s = []uint32{\n", varName)
+	for _, w := range code {
+		fmt.Fprintf(&b, "0x%08x,\n", w)
+	}
+	fmt.Fprintf(&b, "}\n")
+	return format.Source(b.Bytes())
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/aamcrae/pru"
+)
+
+// TestGenerate checks the generated source against the swap example.
+func TestGenerate(t *testing.T) {
+	code, err := pru.ReadImgFile("../../examples/swap/prucode.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate("prucode.img", "main", "prucode_img", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("../../examples/swap/prucode_img.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, want) {
+		t.Errorf("generated source does not match:\n%s", src)
+	}
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	for _, names := range [][2]string{
+		{"main", "1var"},
+		{"main", "a-b"},
+		{"my pkg", "code"},
+	} {
+		if _, err := generate("prog.img", names[0], names[1], []uint32{1}); err == nil {
+			t.Errorf("package %q, variable %q: expected error", names[0], names[1])
+		}
+	}
+}
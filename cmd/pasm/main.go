@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// pasm assembles PRU assembler source using the asm package, as a replacement
+// for the TI pasm assembler, accepting the same options for the output files e.g
+//
+//	//go:generate go run github.com/aamcrae/pru/cmd/pasm -b prucode.p
+//
+// reads prucode.p and creates the binary file prucode.bin. The -m option creates
+// an image file (prucode.img) that may be converted to Go source using img2go.
+// If neither option is specified, the binary file is created.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aamcrae/pru/asm"
+)
+
+var bin = flag.Bool("b", false, "Create little-endian binary file (<name>.bin)")
+var img = flag.Bool("m", false, "Create image file (<name>.img)")
+var defines = make(defineFlag)
+
+// defineFlag collects the -D flags.
+type defineFlag map[string]string
+
+func (d defineFlag) String() string {
+	return ""
+}
+
+func (d defineFlag) Set(s string) error {
+	v := ""
+	if i := strings.IndexByte(s, '='); i >= 0 {
+		s, v = s[:i], s[i+1:]
+	}
+	d[s] = v
+	return nil
+}
+
+func main() {
+	flag.Var(defines, "D", "Define name[=value] (may be repeated)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file.p [output name]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 && flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	in := flag.Arg(0)
+	out := strings.TrimSuffix(in, filepath.Ext(in))
+	if flag.NArg() == 2 {
+		out = flag.Arg(1)
+	}
+	if !*bin && !*img {
+		*bin = true
+	}
+	prog, err := asm.AssembleFileWithDefines(in, defines)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *bin {
+		if err := write(out+".bin", prog.WriteBin); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if *img {
+		if err := write(out+".img", prog.WriteImg); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+}
+
+// write creates the file and writes the program to it.
+func write(name string, wr func(w io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := wr(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,515 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// prudbg is an interactive debugger for PRU programs e.g
+//
+//	prudbg -u 0 prucode.p
+//
+// loads the program (a pasm source file, a binary or image file, or an ELF executable)
+// into the unit, and accepts commands to run the program, set breakpoints, single step,
+// and display the registers, memory and instructions. Instruction addresses are word
+// addresses (as used by pasm), and data addresses are byte offsets.
+// Breakpoints are implemented by replacing the instruction with HALT while the unit
+// is running, and restoring the instruction when the unit halts (using the breakpoint package).
+// The -sim flag runs the program in the PRU simulator rather than on the PRU hardware.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aamcrae/pru"
+	"github.com/aamcrae/pru/asm"
+	"github.com/aamcrae/pru/internal/breakpoint"
+	"github.com/aamcrae/pru/sim"
+)
+
+const iramWords = 8 * 1024 / 4
+
+var unit = flag.Int("u", 0, "PRU unit to debug (0 or 1)")
+var simulate = flag.Bool("sim", false, "Use the PRU simulator")
+
+// command is a debugger command.
+type command struct {
+	name  string
+	args  string
+	help  string
+	fn    func(d *debugger, args []string) error
+	alias []string
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"load", "file", "Load a program (.p, .bin, .img or ELF executable)", (*debugger).load, []string{"l"}},
+		{"run", "[addr]", "Reset and run the program from the address (default is the entry point)", (*debugger).run, nil},
+		{"go", "", "Continue running from the current PC", (*debugger).cont, []string{"g", "c"}},
+		{"halt", "", "Halt the unit", (*debugger).halt, nil},
+		{"step", "[count]", "Single step instructions", (*debugger).step, []string{"s", "ss"}},
+		{"break", "[addr]", "Set a breakpoint, or list the breakpoints", (*debugger).setBreak, []string{"b", "br"}},
+		{"delete", "[addr]", "Delete a breakpoint, or all breakpoints", (*debugger).delBreak, []string{"d"}},
+		{"regs", "", "Display the registers", (*debugger).regs, []string{"r"}},
+		{"set", "reg value", "Set a register e.g set r4 0x100", (*debugger).set, nil},
+		{"dis", "[addr] [count]", "Disassemble instructions (default is around the PC)", (*debugger).dis, []string{"di"}},
+		{"dd", "[offset] [length]", "Dump the unit's data RAM", (*debugger).dumpData, nil},
+		{"ds", "[offset] [length]", "Dump the shared RAM", (*debugger).dumpShared, nil},
+		{"help", "", "Display the commands", (*debugger).help, []string{"h", "?"}},
+		{"quit", "", "Exit the debugger", nil, []string{"q", "exit"}},
+	}
+}
+
+// debugger holds the state of the debugging session.
+type debugger struct {
+	p      *pru.PRU
+	u      *pru.Unit
+	sim    *sim.Sim
+	labels map[string]uint // Word address of program labels
+	entry  uint            // Word address of entry point
+	bps    *breakpoint.Set
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [program]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 || *unit < 0 || *unit > 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	d := new(debugger)
+	pc := pru.NewConfig().EnableUnit(*unit)
+	var err error
+	if *simulate {
+		d.sim = sim.New()
+		d.p, err = pru.OpenWithBackend(pc, d.sim)
+		if err != nil {
+			d.sim.Close()
+		}
+	} else {
+		d.p, err = pru.Open(pc)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer d.p.Close()
+	d.u = d.p.Unit(*unit)
+	d.bps = breakpoint.New(d.u)
+	if flag.NArg() == 1 {
+		if err := d.load([]string{flag.Arg(0)}); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	d.interact(os.Stdin)
+}
+
+// interact reads and executes commands until EOF or quit.
+// An empty line repeats the previous command.
+func (d *debugger) interact(r io.Reader) {
+	in := bufio.NewScanner(r)
+	var last []string
+	for {
+		fmt.Print("prudbg> ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		args := strings.Fields(in.Text())
+		if len(args) == 0 {
+			if args = last; len(args) == 0 {
+				continue
+			}
+		}
+		last = args
+		c := lookup(args[0])
+		if c == nil {
+			fmt.Printf("Unknown command %q, use help to list commands\n", args[0])
+			continue
+		}
+		if c.fn == nil {
+			return
+		}
+		if err := c.fn(d, args[1:]); err != nil {
+			fmt.Printf("%s: %v\n", c.name, err)
+		}
+	}
+}
+
+// lookup finds the command by name or alias.
+func lookup(name string) *command {
+	name = strings.ToLower(name)
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+		for _, a := range c.alias {
+			if a == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// load loads the program into the unit's IRAM.
+func (d *debugger) load(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("file name required")
+	}
+	f := args[0]
+	d.labels = nil
+	d.entry = 0
+	switch filepath.Ext(f) {
+	case ".p":
+		prog, err := asm.AssembleFile(f)
+		if err != nil {
+			return err
+		}
+		if err := d.u.LoadAt(prog.Code, 0); err != nil {
+			return err
+		}
+		d.labels = make(map[string]uint)
+		for l, a := range prog.Labels {
+			d.labels[l] = a / 4
+		}
+		d.entry = prog.Entry / 4
+	case ".img":
+		if err := d.u.LoadImgFile(f); err != nil {
+			return err
+		}
+	case ".bin":
+		if err := d.u.LoadFile(f); err != nil {
+			return err
+		}
+	default:
+		entry, err := d.u.LoadELFFile(f)
+		if err != nil {
+			return err
+		}
+		d.entry = entry / 4
+	}
+	fmt.Printf("Loaded %s, entry point 0x%04x\n", f, d.entry)
+	return nil
+}
+
+// run resets the unit and runs the program from the start address.
+func (d *debugger) run(args []string) error {
+	start := d.entry
+	if len(args) > 0 {
+		var err error
+		if start, err = d.address(args[0]); err != nil {
+			return err
+		}
+	}
+	if err := d.bps.RunAt(start * 4); err != nil {
+		return err
+	}
+	d.wait()
+	return nil
+}
+
+// cont continues running from the current PC. If there is a breakpoint at the
+// current PC, the instruction is stepped before the breakpoints are inserted.
+func (d *debugger) cont(args []string) error {
+	if d.u.IsRunning() {
+		return fmt.Errorf("unit is running")
+	}
+	if err := d.bps.Resume(); err != nil {
+		return err
+	}
+	d.wait()
+	return nil
+}
+
+// wait waits for the unit to halt, or for an interrupt from the keyboard.
+func (d *debugger) wait() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	fmt.Println("Running, interrupt to halt")
+	for d.u.IsRunning() {
+		select {
+		case <-sig:
+			d.u.Halt()
+			fmt.Println("Interrupted")
+		case <-t.C:
+		}
+	}
+	if err := d.bps.Remove(); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+	pc := d.pc()
+	if d.bps.Has(pc * 4) {
+		fmt.Printf("Breakpoint at 0x%04x\n", pc)
+	} else {
+		fmt.Printf("Halted at 0x%04x\n", pc)
+	}
+	if d.sim != nil {
+		if err := d.sim.Error(*unit); err != nil {
+			fmt.Printf("Simulator error: %v\n", err)
+		}
+	}
+	d.show(pc, 1)
+}
+
+// halt halts the unit.
+func (d *debugger) halt(args []string) error {
+	d.u.Halt()
+	d.show(d.pc(), 1)
+	return nil
+}
+
+// step single steps one or more instructions.
+func (d *debugger) step(args []string) error {
+	n := uint(1)
+	if len(args) > 0 {
+		v, err := strconv.ParseUint(args[0], 0, 32)
+		if err != nil {
+			return err
+		}
+		n = uint(v)
+	}
+	for i := uint(0); i < n; i++ {
+		if err := d.u.Step(); err != nil {
+			return err
+		}
+		if d.sim != nil {
+			if err := d.sim.Error(*unit); err != nil {
+				return err
+			}
+		}
+	}
+	d.show(d.pc(), 1)
+	return nil
+}
+
+// setBreak sets a breakpoint, or lists the current breakpoints.
+func (d *debugger) setBreak(args []string) error {
+	if len(args) == 0 {
+		for _, a := range d.bps.List() {
+			d.show(a/4, 1)
+		}
+		return nil
+	}
+	a, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	return d.bps.Add(a * 4)
+}
+
+// delBreak deletes a breakpoint, or all breakpoints.
+func (d *debugger) delBreak(args []string) error {
+	if len(args) == 0 {
+		d.bps.Clear()
+		return nil
+	}
+	a, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	if !d.bps.Delete(a * 4) {
+		return fmt.Errorf("no breakpoint at 0x%04x", a)
+	}
+	return nil
+}
+
+// regs displays the registers.
+func (d *debugger) regs(args []string) error {
+	r, err := d.u.Registers()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("PC: 0x%04x\n", d.pc())
+	for i := 0; i < len(r); i += 4 {
+		for j := i; j < i+4; j++ {
+			fmt.Printf("  r%-2d: 0x%08x", j, r[j])
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// set sets the value of a register.
+func (d *debugger) set(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("register and value required")
+	}
+	r := strings.ToLower(args[0])
+	if !strings.HasPrefix(r, "r") {
+		return fmt.Errorf("invalid register %s", args[0])
+	}
+	n, err := strconv.Atoi(r[1:])
+	if err != nil {
+		return fmt.Errorf("invalid register %s", args[0])
+	}
+	v, err := strconv.ParseUint(args[1], 0, 32)
+	if err != nil {
+		return err
+	}
+	return d.u.SetRegister(n, uint32(v))
+}
+
+// dis disassembles the instructions at the address, or around the PC.
+func (d *debugger) dis(args []string) error {
+	a := d.pc()
+	n := uint(10)
+	if len(args) > 0 {
+		var err error
+		if a, err = d.address(args[0]); err != nil {
+			return err
+		}
+	} else if a >= 4 {
+		a -= 4
+	} else {
+		a = 0
+	}
+	if len(args) > 1 {
+		v, err := strconv.ParseUint(args[1], 0, 32)
+		if err != nil {
+			return err
+		}
+		n = uint(v)
+	}
+	if a+n > iramWords {
+		n = iramWords - a
+	}
+	d.show(a, n)
+	return nil
+}
+
+// show disassembles the instructions, marking the PC and the breakpoints.
+func (d *debugger) show(a, n uint) {
+	code, err := d.u.ReadIRAM(a*4, n)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	pc := d.pc()
+	for _, i := range asm.Disassemble(code, a*4) {
+		wa := i.Addr / 4
+		mark := ' '
+		if d.bps.Has(i.Addr) {
+			mark = '*'
+		}
+		if wa == pc {
+			mark = '>'
+		}
+		fmt.Printf("%c %s%s\n", mark, i, d.label(wa))
+	}
+}
+
+// label returns the labels at the address.
+func (d *debugger) label(a uint) string {
+	var l []string
+	for s, v := range d.labels {
+		if v == a {
+			l = append(l, s)
+		}
+	}
+	if len(l) == 0 {
+		return ""
+	}
+	sort.Strings(l)
+	return "\t; " + strings.Join(l, ", ")
+}
+
+// dumpData dumps the unit's data RAM.
+func (d *debugger) dumpData(args []string) error {
+	return dump(d.u.Ram, d.p.Order, args)
+}
+
+// dumpShared dumps the shared RAM.
+func (d *debugger) dumpShared(args []string) error {
+	return dump(d.p.SharedRam, d.p.Order, args)
+}
+
+// dump displays the memory as hex 32 bit words.
+func dump(mem []byte, order binary.ByteOrder, args []string) error {
+	offs, n := uint64(0), uint64(64)
+	var err error
+	if len(args) > 0 {
+		if offs, err = strconv.ParseUint(args[0], 0, 32); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 {
+		if n, err = strconv.ParseUint(args[1], 0, 32); err != nil {
+			return err
+		}
+	}
+	offs &^= 3
+	if offs >= uint64(len(mem)) {
+		return fmt.Errorf("offset 0x%x out of range", offs)
+	}
+	if offs+n > uint64(len(mem)) {
+		n = uint64(len(mem)) - offs
+	}
+	for a := offs; a < offs+n; a += 16 {
+		fmt.Printf("0x%04x:", a)
+		for i := a; i < a+16 && i+4 <= uint64(len(mem)) && i < offs+n; i += 4 {
+			fmt.Printf(" %08x", order.Uint32(mem[i:]))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// help lists the commands.
+func (d *debugger) help(args []string) error {
+	for _, c := range commands {
+		name := c.name
+		if len(c.alias) != 0 {
+			name += " (" + strings.Join(c.alias, ", ") + ")"
+		}
+		fmt.Printf("%-16s %-18s %s\n", name, c.args, c.help)
+	}
+	fmt.Println("An empty line repeats the previous command.")
+	return nil
+}
+
+// pc returns the word address of the current PC.
+func (d *debugger) pc() uint {
+	return d.u.PC() / 4
+}
+
+// address parses an instruction word address, which may be a label.
+func (d *debugger) address(s string) (uint, error) {
+	if a, ok := d.labels[s]; ok {
+		return a, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q", s)
+	}
+	if v >= iramWords {
+		return 0, fmt.Errorf("address 0x%x out of range", v)
+	}
+	return uint(v), nil
+}
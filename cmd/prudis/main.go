@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// prudis disassembles PRU programs, either from binary (.bin) or image (.img) files,
+// or from the IRAM of a PRU unit e.g
+//
+//	prudis prucode.bin
+//	prudis -unit 0 -n 32
+//
+// The output is in the style of a pasm listing, so that the program
+// loaded in a unit can be compared against the expected program using diff.
+// The unit is not reset, so the program running on the unit may be inspected; a running
+// unit is halted while the IRAM is read, and then resumed.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/aamcrae/pru"
+	"github.com/aamcrae/pru/asm"
+)
+
+const iramWords = 8 * 1024 / 4
+
+var unit = flag.Int("unit", -1, "Disassemble the IRAM of the PRU unit (0 or 1)")
+var addr = flag.Uint("addr", 0, "Byte address of the first instruction")
+var count = flag.Uint("n", 0, "Number of instructions to read from IRAM (default is to the end of IRAM)")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [file.bin | file.img ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if *unit >= 0 {
+		if flag.NArg() != 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		code, err := readUnit(*unit, *addr, *count)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		asm.Listing(w, code, *addr)
+		return
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	for _, f := range flag.Args() {
+		code, err := readFile(f)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if flag.NArg() > 1 {
+			fmt.Fprintf(w, "%s:\n", f)
+		}
+		asm.Listing(w, code, *addr)
+	}
+}
+
+// readFile reads the program from an image file or a little-endian binary file.
+func readFile(f string) ([]uint32, error) {
+	if filepath.Ext(f) == ".img" {
+		return pru.ReadImgFile(f)
+	}
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(b)%4 != 0 {
+		return nil, fmt.Errorf("%s: length is not 32 bit aligned", f)
+	}
+	code := make([]uint32, len(b)/4)
+	for i := range code {
+		code[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return code, nil
+}
+
+// readUnit reads the program from the unit's IRAM.
+func readUnit(u int, addr, n uint) ([]uint32, error) {
+	if addr >= iramWords*4 {
+		return nil, fmt.Errorf("address 0x%x is beyond the end of IRAM", addr)
+	}
+	if n == 0 {
+		n = iramWords - addr/4
+	}
+	p, err := pru.Open(pru.NewConfig().EnableUnit(u).NoReset())
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	pu := p.Unit(u)
+	if pu.IsRunning() {
+		// The IRAM cannot be read while the unit is running.
+		pu.Halt()
+		defer pu.Resume()
+	}
+	return pu.ReadIRAM(addr, n)
+}
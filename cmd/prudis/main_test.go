@@ -0,0 +1,29 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+// TestReadUnitRange checks that an address beyond IRAM is rejected
+// before the PRU is opened.
+func TestReadUnitRange(t *testing.T) {
+	for _, addr := range []uint{iramWords * 4, iramWords*4 + 4, ^uint(0) &^ 3} {
+		if _, err := readUnit(0, addr, 0); err == nil {
+			t.Errorf("address %#x: expected error", addr)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// prugdb serves the GDB remote protocol for a PRU unit, so that programs
+// can be debugged using gdb e.g
+//
+//	prugdb -u 0 firmware.out
+//
+// loads the program (an ELF executable, a pasm source file, or a binary or image file)
+// into the unit, and waits for gdb to connect:
+//
+//	gdb-multiarch firmware.out
+//	(gdb) set architecture pru
+//	(gdb) target remote localhost:2345
+//
+// The -imem flag sets the address used by gdb for the instruction memory.
+// By default, the address is taken from an ELF executable (0x20000000 for the
+// GNU PRU toolchain, 0 for clpru), and is otherwise 0x20000000.
+// The -sim flag runs the program in the PRU simulator rather than on the PRU hardware.
+package main
+
+import (
+	"debug/elf"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/aamcrae/pru"
+	"github.com/aamcrae/pru/asm"
+	"github.com/aamcrae/pru/gdb"
+	"github.com/aamcrae/pru/sim"
+)
+
+var unit = flag.Int("u", 0, "PRU unit to debug (0 or 1)")
+var addr = flag.String("addr", "localhost:2345", "TCP address to listen on")
+var imem = flag.Uint("imem", 0x20000000, "GDB address of the instruction memory")
+var simulate = flag.Bool("sim", false, "Use the PRU simulator")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [program]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 || *unit < 0 || *unit > 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	pc := pru.NewConfig().EnableUnit(*unit)
+	var p *pru.PRU
+	var err error
+	if *simulate {
+		s := sim.New()
+		p, err = pru.OpenWithBackend(pc, s)
+		if err != nil {
+			s.Close()
+		}
+	} else {
+		p, err = pru.Open(pc)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer p.Close()
+	s, err := gdb.NewServer(p, *unit)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	s.IMem = uint32(*imem)
+	if flag.NArg() == 1 {
+		if !isSet("imem") && isELF(flag.Arg(0)) {
+			if s.IMem, err = elfIMem(flag.Arg(0)); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		entry, err := load(p.Unit(*unit), flag.Arg(0))
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := s.SetPC(entry); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	log.Printf("Listening on %s for unit %d", *addr, *unit)
+	log.Fatalf("%v", s.ListenAndServe(*addr))
+}
+
+// load loads the program into the unit, returning the byte address of the entry point.
+func load(u *pru.Unit, f string) (uint, error) {
+	switch filepath.Ext(f) {
+	case ".p":
+		prog, err := asm.AssembleFile(f)
+		if err != nil {
+			return 0, err
+		}
+		return prog.Entry, u.LoadAt(prog.Code, 0)
+	case ".img":
+		return 0, u.LoadImgFile(f)
+	case ".bin":
+		return 0, u.LoadFile(f)
+	}
+	return u.LoadELFFile(f)
+}
+
+// isELF returns true if the program file is loaded as an ELF executable.
+func isELF(f string) bool {
+	switch filepath.Ext(f) {
+	case ".p", ".img", ".bin":
+		return false
+	}
+	return true
+}
+
+// isSet returns true if the flag was set on the command line.
+func isSet(name string) bool {
+	var set bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// elfIMem returns the address of the instruction memory in the ELF executable, which
+// is 0x20000000 if the program was built with the GNU PRU toolchain, and 0 otherwise.
+func elfIMem(name string) (uint32, error) {
+	f, err := elf.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	for _, s := range f.Sections {
+		if (s.Flags&elf.SHF_EXECINSTR) != 0 && s.Size != 0 && s.Addr >= 0x20000000 {
+			return 0x20000000, nil
+		}
+	}
+	return 0, nil
+}
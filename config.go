@@ -14,6 +14,10 @@
 
 package pru
 
+import (
+	"time"
+)
+
 const (
 	nEvents   = 64            // Number of system events
 	nChannels = 10            // Number of interrupt channels
@@ -22,6 +26,9 @@ const (
 	nSignals  = nHostInts - 2 // Number of host interrupts routed to CPU
 )
 
+// Default interval for polling the unit's status when waiting for the unit to halt.
+const defaultHaltPoll = time.Millisecond
+
 // Config contains the configuration mappings for the PRU.
 // A configuration is initialised through config methods on this structure e.g:
 //   ic := NewConfig()
@@ -32,6 +39,19 @@ type Config struct {
 	umask     int
 	ev2chan   map[byte]byte
 	chan2hint map[byte]byte
+	rpmsg     map[byte]int
+	root      string
+	verify    bool
+	noReset   bool
+	haltPoll  time.Duration
+	ctab      [nUnits]map[int]uint16 // Programmable constant table entries
+	queues    map[byte]queue
+}
+
+// queue is the queue depth and overflow policy of an event.
+type queue struct {
+	depth  int
+	policy OverflowPolicy
 }
 
 // The default config.
@@ -70,6 +90,15 @@ func (ic *Config) Clear() *Config {
 	ic.umask = 0
 	ic.ev2chan = make(map[byte]byte)
 	ic.chan2hint = make(map[byte]byte)
+	ic.rpmsg = make(map[byte]int)
+	ic.root = ""
+	ic.verify = false
+	ic.noReset = false
+	ic.haltPoll = defaultHaltPoll
+	ic.queues = make(map[byte]queue)
+	for i := range ic.ctab {
+		ic.ctab[i] = make(map[int]uint16)
+	}
 	return ic
 }
 
@@ -98,3 +127,95 @@ func (ic *Config) Channel2Interrupt(c, h int) *Config {
 	ic.chan2hint[byte(c % nChannels)] = byte(h % nHostInts)
 	return ic
 }
+
+// Rpmsg maps the rpmsg device /dev/rpmsg_pru<ch> to the system event, so
+// that each message received on the device is delivered as the event.
+// This is only used when the PRU cores are managed by the RemoteProc driver,
+// where the interrupt controller is owned by the kernel and the event to channel
+// and channel to host interrupt mappings are not used.
+// The device is created by the firmware, so it is opened when the PRU is opened if present,
+// otherwise after the firmware is started using Unit.LoadFirmware.
+func (ic *Config) Rpmsg(s, ch int) *Config {
+	ic.rpmsg[byte(s%nEvents)] = ch
+	return ic
+}
+
+// EventQueue sets the depth of the queue of received events for the system event,
+// and the policy used when an event is received and the queue is full.
+// The default is a queue depth of 50, with new events dropped when the queue is full.
+// If the policy is Block, events received while the queue is full are held
+// until there is space in the queue; other events are not delayed. At most depth events
+// are held, and events received when that many are already held are dropped.
+func (ic *Config) EventQueue(s, depth int, policy OverflowPolicy) *Config {
+	if depth < 1 {
+		depth = 1
+	}
+	ic.queues[byte(s%nEvents)] = queue{depth, policy}
+	return ic
+}
+
+// newEvent creates the Event for the system event, using the queue configuration.
+func (ic *Config) newEvent(s byte) *Event {
+	if q, ok := ic.queues[s]; ok {
+		return newEvent(q.depth, q.policy)
+	}
+	return newEvent(defaultQueueDepth, DropNewest)
+}
+
+// VerifyLoad enables verification of programs loaded into IRAM, so that
+// the IRAM is read back after each load and compared against the program.
+// A corrupted load returns an error, and the LoadAndRun methods
+// will not enable the unit.
+func (ic *Config) VerifyLoad() *Config {
+	ic.verify = true
+	return ic
+}
+
+// NoReset leaves the enabled units in their current state when the PRU is opened
+// and closed, rather than resetting them, so that a running program can be inspected
+// without being stopped. If the PRU cores are managed by the RemoteProc driver, running
+// units are not stopped when the PRU is opened.
+func (ic *Config) NoReset() *Config {
+	ic.noReset = true
+	return ic
+}
+
+// HaltPoll sets the interval used by WaitHalt to poll the unit's status.
+// A shorter interval reduces the latency of detecting that a unit has halted
+// at the cost of more CPU time. The default is 1 millisecond.
+func (ic *Config) HaltPoll(d time.Duration) *Config {
+	if d > 0 {
+		ic.haltPoll = d
+	}
+	return ic
+}
+
+// ConstBlock sets the block index of the constant table entry c (C24 to C27)
+// of the unit, which is applied when the PRU is opened, before any program is run.
+// Entries that are not in the range are ignored.
+func (ic *Config) ConstBlock(u, c int, index uint8) *Config {
+	if c >= 24 && c <= 27 {
+		ic.ctab[u%nUnits][c] = uint16(index)
+	}
+	return ic
+}
+
+// ConstPointer sets the pointer of the constant table entry c (C28 to C31)
+// of the unit, which is applied when the PRU is opened, before any program is run.
+// Entries that are not in the range are ignored.
+func (ic *Config) ConstPointer(u, c int, ptr uint16) *Config {
+	if c >= 28 && c <= 31 {
+		ic.ctab[u%nUnits][c] = ptr
+	}
+	return ic
+}
+
+// Root sets the root directory that is prepended to the sysfs, device and
+// firmware paths used to discover and access the PRU subsystem e.g
+// setting the root to "/tmp/fake" will read the UIO devices from
+// /tmp/fake/sys/class/uio and open /tmp/fake/dev/uio0 etc.
+// The default is to use the system root.
+func (ic *Config) Root(dir string) *Config {
+	ic.root = dir
+	return ic
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// device is an event device read by the dispatcher.
+type device struct {
+	f        *os.File
+	fd       int // File descriptor, if the device is polled
+	buf      []byte
+	reenable bool         // Write 1 to the device after each read (the UIO protocol)
+	handle   func([]byte) // Invoked with the data read from the device
+	failed   func(error)  // Invoked if reading the device fails
+}
+
+// reader reads a device that is not polled, until
+// the read fails. Such devices are not UIO devices, so the interrupt
+// is not re-enabled. The end of the device, or the device being closed,
+// is not reported as a failure.
+func (d *dispatcher) reader(dev *device) {
+	defer d.wg.Done()
+	for {
+		n, err := dev.f.Read(dev.buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				dev.failed(err)
+			}
+			return
+		}
+		dev.handle(dev.buf[:n])
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package pru
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Maximum number of epoll events read at a time.
+const maxEpollEvents = 16
+
+// dispatcher reads the event devices (the UIO signal devices or the rpmsg devices)
+// in a single goroutine, using epoll to wait on all of the devices.
+// A pipe is used to wake the goroutine when the dispatcher is closed.
+// Devices that do not support epoll (such as regular files in a test
+// device tree) are read by a separate goroutine.
+// A device that fails (or is closed by the driver) is removed, and
+// its failure is reported; if epoll fails, the failure is reported to fail.
+// Devices may be added and removed while the goroutine is running.
+type dispatcher struct {
+	epfd    int
+	wake    [2]int     // Read and write ends of the wake pipe
+	mu      sync.Mutex // Protects devs and other
+	devs    map[int]*device
+	other   []*device // Devices that do not support epoll
+	fail    func(error)
+	done    chan struct{}
+	wg      sync.WaitGroup
+	started bool
+}
+
+// newDispatcher creates the epoll instance and the wake pipe.
+func newDispatcher(fail func(error)) (*dispatcher, error) {
+	d := &dispatcher{devs: make(map[int]*device), fail: fail, done: make(chan struct{})}
+	var err error
+	d.epfd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Pipe2(d.wake[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		unix.Close(d.epfd)
+		return nil, err
+	}
+	if err := d.watch(d.wake[0]); err != nil {
+		d.close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// watch adds the file descriptor to the epoll set.
+func (d *dispatcher) watch(fd int) error {
+	ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}
+	return unix.EpollCtl(d.epfd, unix.EPOLL_CTL_ADD, fd, &ev)
+}
+
+// add adds the device to the dispatcher. Each read of the device reads up to size bytes.
+// If the device fails, it is closed and failed is invoked with the error.
+// The device is closed when the dispatcher is closed (or if it cannot be added).
+func (d *dispatcher) add(f *os.File, size int, reenable bool, handle func([]byte), failed func(error)) (*device, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fd := -1
+	rc.Control(func(s uintptr) {
+		fd = int(s)
+	})
+	if fd < 0 {
+		f.Close()
+		return nil, fmt.Errorf("%s: no file descriptor", f.Name())
+	}
+	dev := &device{f: f, fd: fd, buf: make([]byte, size), reenable: reenable, handle: handle, failed: failed}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.watch(fd); err != nil {
+		if err != unix.EPERM {
+			f.Close()
+			return nil, err
+		}
+		d.other = append(d.other, dev)
+		if d.started {
+			d.wg.Add(1)
+			go d.reader(dev)
+		}
+		return dev, nil
+	}
+	d.devs[fd] = dev
+	return dev, nil
+}
+
+// remove removes the device from the dispatcher, and closes it.
+func (d *dispatcher) remove(dev *device) {
+	d.mu.Lock()
+	if d.devs[dev.fd] == dev {
+		unix.EpollCtl(d.epfd, unix.EPOLL_CTL_DEL, dev.fd, nil)
+		delete(d.devs, dev.fd)
+	}
+	for i, o := range d.other {
+		if o == dev {
+			d.other = append(d.other[:i], d.other[i+1:]...)
+			break
+		}
+	}
+	d.mu.Unlock()
+	dev.f.Close()
+}
+
+// start starts the goroutine that reads the devices.
+func (d *dispatcher) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = true
+	go d.run()
+	for _, dev := range d.other {
+		d.wg.Add(1)
+		go d.reader(dev)
+	}
+}
+
+// run waits for the devices to be readable, and reads them
+// until the wake pipe is written.
+func (d *dispatcher) run() {
+	defer close(d.done)
+	events := make([]unix.EpollEvent, maxEpollEvents)
+	for {
+		n, err := unix.EpollWait(d.epfd, events, -1)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			d.fail(fmt.Errorf("epoll: %v", err))
+			return
+		}
+		for _, ev := range events[:n] {
+			fd := int(ev.Fd)
+			if fd == d.wake[0] {
+				return
+			}
+			d.mu.Lock()
+			dev, ok := d.devs[fd]
+			d.mu.Unlock()
+			if ok {
+				if err := dev.read(); err != nil {
+					d.drop(dev, err)
+				}
+			}
+		}
+	}
+}
+
+// drop removes a failed device from the epoll set and closes it,
+// so that a device that remains readable (e.g on EPOLLHUP) is not polled again.
+// A device that has already been removed is ignored.
+func (d *dispatcher) drop(dev *device, err error) {
+	d.mu.Lock()
+	if d.devs[dev.fd] != dev {
+		d.mu.Unlock()
+		return
+	}
+	unix.EpollCtl(d.epfd, unix.EPOLL_CTL_DEL, dev.fd, nil)
+	delete(d.devs, dev.fd)
+	d.mu.Unlock()
+	dev.f.Close()
+	dev.failed(fmt.Errorf("%s: %v", dev.f.Name(), err))
+}
+
+// read reads the device and invokes the handler.
+// An error is returned if the device has failed or reached EOF.
+func (dev *device) read() error {
+	n, err := unix.Read(dev.fd, dev.buf)
+	if err != nil {
+		if err == unix.EAGAIN || err == unix.EINTR {
+			// Nothing to read.
+			return nil
+		}
+		return err
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	dev.handle(dev.buf[:n])
+	if dev.reenable {
+		// Re-enable the interrupt.
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], 1)
+		unix.Write(dev.fd, b[:])
+	}
+	return nil
+}
+
+// close stops the goroutine (waiting for it to exit), and closes the devices.
+func (d *dispatcher) close() {
+	if d.started {
+		unix.Write(d.wake[1], []byte{0})
+		<-d.done
+	}
+	d.mu.Lock()
+	for fd, dev := range d.devs {
+		dev.f.Close()
+		delete(d.devs, fd)
+	}
+	for _, dev := range d.other {
+		dev.f.Close()
+	}
+	d.other = nil
+	d.mu.Unlock()
+	if d.started {
+		d.wg.Wait()
+		d.started = false
+	}
+	unix.Close(d.wake[0])
+	unix.Close(d.wake[1])
+	unix.Close(d.epfd)
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package pru
+
+import (
+	"os"
+	"sync"
+)
+
+// dispatcher reads the event devices on systems without epoll,
+// using a separate goroutine for each device.
+// UIO is only available on Linux, so the interrupts are not re-enabled.
+// Devices may be added and removed while the goroutines are running.
+type dispatcher struct {
+	mu      sync.Mutex // Protects devs and started
+	devs    []*device
+	wg      sync.WaitGroup
+	started bool
+}
+
+// newDispatcher creates an empty dispatcher. Since the devices
+// are read by separate goroutines, fail is not used.
+func newDispatcher(fail func(error)) (*dispatcher, error) {
+	return &dispatcher{}, nil
+}
+
+// add adds the device to the dispatcher. Each read of the device reads up to size bytes.
+// If the device fails, failed is invoked with the error.
+// The device is closed when the dispatcher is closed.
+func (d *dispatcher) add(f *os.File, size int, reenable bool, handle func([]byte), failed func(error)) (*device, error) {
+	dev := &device{f: f, fd: -1, buf: make([]byte, size), handle: handle, failed: failed}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.devs = append(d.devs, dev)
+	if d.started {
+		d.wg.Add(1)
+		go d.reader(dev)
+	}
+	return dev, nil
+}
+
+// remove removes the device from the dispatcher, and closes it.
+func (d *dispatcher) remove(dev *device) {
+	d.mu.Lock()
+	for i, o := range d.devs {
+		if o == dev {
+			d.devs = append(d.devs[:i], d.devs[i+1:]...)
+			break
+		}
+	}
+	d.mu.Unlock()
+	dev.f.Close()
+}
+
+// start starts a goroutine to read each device.
+func (d *dispatcher) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = true
+	for _, dev := range d.devs {
+		d.wg.Add(1)
+		go d.reader(dev)
+	}
+}
+
+// close closes the devices, and waits for the goroutines to exit.
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	for _, dev := range d.devs {
+		dev.f.Close()
+	}
+	d.devs = nil
+	started := d.started
+	d.started = false
+	d.mu.Unlock()
+	if started {
+		d.wg.Wait()
+	}
+}
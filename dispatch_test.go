@@ -0,0 +1,50 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestDeviceFailure checks that a failed event device is removed
+// from the dispatcher, and that the failure is reported.
+func TestDeviceFailure(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	if err := p.Err(); err != nil {
+		t.Fatalf("Err before failure: %v", err)
+	}
+	// Closing the simulator closes its end of the signal devices.
+	s.Close()
+	deadline := time.Now().Add(testTimeout)
+	for p.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("device failure not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// A failed device is removed, so the dispatcher does not
+	// spin reading it; check that little CPU time is used while idle.
+	var before, after unix.Rusage
+	unix.Getrusage(unix.RUSAGE_SELF, &before)
+	time.Sleep(200 * time.Millisecond)
+	unix.Getrusage(unix.RUSAGE_SELF, &after)
+	used := time.Duration(after.Utime.Nano() + after.Stime.Nano() - before.Utime.Nano() - before.Stime.Nano())
+	if used > 100*time.Millisecond {
+		t.Errorf("%v of CPU time used while idle", used)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+)
+
+// Address of IRAM in ELF executables generated by the GNU PRU toolchain.
+const gnuIRamBase = 0x20000000
+
+// LoadELFFile loads the ELF executable file (as generated by the TI clpru compiler
+// or the GNU PRU toolchain), returning the entry point address.
+func (u *Unit) LoadELFFile(s string) (uint, error) {
+	f, err := elf.Open(s)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return u.loadELF(f)
+}
+
+// LoadAndRunELFFile loads the ELF executable file, and runs the
+// program at the entry point.
+func (u *Unit) LoadAndRunELFFile(s string) error {
+	entry, err := u.LoadELFFile(s)
+	if err != nil {
+		return err
+	}
+	return u.RunAt(entry)
+}
+
+// LoadELF loads the ELF executable (as generated by the TI clpru compiler
+// or the GNU PRU toolchain), returning the entry point address as an IRAM byte address.
+// Executable sections (e.g .text) are loaded into the unit's IRAM, which is at address 0
+// for clpru and 0x20000000 for the GNU toolchain. Other sections
+// (e.g .data and .bss) are loaded into the unit's data RAM, the other unit's data RAM or
+// the shared RAM according to the section address, using the memory map of the unit i.e
+// address 0x0000 is the unit's data RAM, 0x2000 is the other unit's data RAM
+// and 0x10000 is the shared RAM. Sections with no data (e.g .bss) are cleared.
+func (u *Unit) LoadELF(r io.ReaderAt) (uint, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return 0, err
+	}
+	return u.loadELF(f)
+}
+
+// loadELF validates the ELF file and loads the allocated sections.
+func (u *Unit) loadELF(f *elf.File) (uint, error) {
+	if f.Class != elf.ELFCLASS32 || f.Machine != elf.EM_TI_PRU {
+		return 0, fmt.Errorf("not a PRU ELF executable")
+	}
+	entry := elfIRamAddr(f.Entry)
+	if entry%4 != 0 || entry >= am3xxIRamSize {
+		return 0, fmt.Errorf("entry point 0x%x is invalid", f.Entry)
+	}
+	// Validate and read all the sections before any memory is written.
+	type section struct {
+		s *elf.Section
+		b []byte // Section data, or nil if the section has no data
+	}
+	var code, data []section
+	for _, s := range f.Sections {
+		if (s.Flags&elf.SHF_ALLOC) == 0 || s.Size == 0 {
+			continue
+		}
+		if (s.Flags & elf.SHF_EXECINSTR) != 0 {
+			addr := elfIRamAddr(s.Addr)
+			if addr%4 != 0 || s.Size%4 != 0 {
+				return 0, fmt.Errorf("%s: section is not 32 bit aligned", s.Name)
+			}
+			if addr >= am3xxIRamSize || s.Size > am3xxIRamSize-addr {
+				return 0, fmt.Errorf("%s: section too large for IRAM", s.Name)
+			}
+		} else if _, err := u.dataRam(s.Addr, s.Size); err != nil {
+			return 0, fmt.Errorf("%s: %v", s.Name, err)
+		}
+		var b []byte
+		if s.Type != elf.SHT_NOBITS {
+			var err error
+			if b, err = s.Data(); err != nil {
+				return 0, fmt.Errorf("%s: %v", s.Name, err)
+			}
+		}
+		if (s.Flags & elf.SHF_EXECINSTR) != 0 {
+			code = append(code, section{s, b})
+		} else {
+			data = append(data, section{s, b})
+		}
+	}
+	// Ensure unit is not running before writing memory.
+	u.Disable()
+	for _, c := range code {
+		prog := make([]uint32, len(c.b)/4)
+		for i := range prog {
+			prog[i] = f.ByteOrder.Uint32(c.b[i*4:])
+		}
+		if err := u.LoadAt(prog, uint(elfIRamAddr(c.s.Addr))); err != nil {
+			return 0, fmt.Errorf("%s: %v", c.s.Name, err)
+		}
+	}
+	for _, d := range data {
+		dst, _ := u.dataRam(d.s.Addr, d.s.Size)
+		if d.b == nil {
+			for i := range dst {
+				dst[i] = 0
+			}
+			continue
+		}
+		copy(dst, d.b)
+	}
+	return uint(entry), nil
+}
+
+// elfIRamAddr converts an instruction address in the ELF file to an IRAM byte address.
+func elfIRamAddr(addr uint64) uint64 {
+	if addr >= gnuIRamBase {
+		return addr - gnuIRamBase
+	}
+	return addr
+}
+
+// dataRam returns the slice of RAM at the address in the unit's data memory map.
+func (u *Unit) dataRam(addr, size uint64) ([]byte, error) {
+	var base uint64
+	var ram []byte
+	switch {
+	case addr < am3xxRamSize:
+		ram = u.Ram
+	case addr >= am3xxPru1Ram && addr < am3xxPru1Ram+am3xxRamSize:
+		// The other unit's RAM.
+		base = am3xxPru1Ram
+		if u.index == 0 {
+			ram = u.pru.mem[am3xxPru1Ram : am3xxPru1Ram+am3xxRamSize]
+		} else {
+			ram = u.pru.mem[am3xxPru0Ram : am3xxPru0Ram+am3xxRamSize]
+		}
+	case addr >= am3xxSharedRam && addr < am3xxSharedRam+am3xxSharedRamSize:
+		base = am3xxSharedRam
+		ram = u.pru.SharedRam
+	default:
+		return nil, fmt.Errorf("address 0x%x is not in data RAM", addr)
+	}
+	if size > base+uint64(len(ram))-addr {
+		return nil, fmt.Errorf("section at 0x%x too large for RAM", addr)
+	}
+	return ram[addr-base : addr-base+size], nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// elfSection describes a section of a test ELF executable.
+type elfSection struct {
+	name  string
+	typ   elf.SectionType
+	flags elf.SectionFlag
+	addr  uint32
+	data  []byte
+	size  uint32 // Size of SHT_NOBITS sections
+}
+
+// Flags of the code and data sections.
+const (
+	textFlags = elf.SHF_ALLOC | elf.SHF_EXECINSTR
+	dataFlags = elf.SHF_ALLOC | elf.SHF_WRITE
+)
+
+// buildELF returns a little endian PRU ELF executable containing the sections.
+func buildELF(entry uint32, sections []elfSection) []byte {
+	strtab := []byte{0}
+	var data bytes.Buffer
+	hdrs := []elf.Section32{{}}
+	off := uint32(binary.Size(elf.Header32{}))
+	for _, s := range append(sections, elfSection{name: ".shstrtab", typ: elf.SHT_STRTAB}) {
+		if s.name == ".shstrtab" {
+			s.data = append(strtab, ".shstrtab\x00"...)
+		}
+		h := elf.Section32{
+			Name:      uint32(len(strtab)),
+			Type:      uint32(s.typ),
+			Flags:     uint32(s.flags),
+			Addr:      s.addr,
+			Off:       off + uint32(data.Len()),
+			Size:      uint32(len(s.data)),
+			Addralign: 4,
+		}
+		if s.typ == elf.SHT_NOBITS {
+			h.Size = s.size
+		}
+		strtab = append(strtab, s.name+"\x00"...)
+		data.Write(s.data)
+		hdrs = append(hdrs, h)
+	}
+	hdr := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_TI_PRU),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     entry,
+		Shoff:     off + uint32(data.Len()),
+		Ehsize:    uint16(off),
+		Shentsize: uint16(binary.Size(elf.Section32{})),
+		Shnum:     uint16(len(hdrs)),
+		Shstrndx:  uint16(len(hdrs) - 1),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, hdr)
+	b.Write(data.Bytes())
+	binary.Write(&b, binary.LittleEndian, hdrs)
+	return b.Bytes()
+}
+
+// le returns the words as little endian bytes.
+func le(code []uint32) []byte {
+	b := make([]byte, len(code)*4)
+	for i, w := range code {
+		binary.LittleEndian.PutUint32(b[i*4:], w)
+	}
+	return b
+}
+
+func TestLoadELF(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  uint32 // Address of IRAM in the ELF file
+		entry uint
+	}{
+		{"clpru", 0, 0x40},
+		{"gnu", gnuIRamBase, 0x40},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, p := openSim(t, DefaultConfig)
+			u := p.Unit(0)
+			for i := range u.Ram {
+				u.Ram[i] = 0xFF
+			}
+			f := buildELF(tc.base+uint32(tc.entry), []elfSection{
+				{name: ".text", typ: elf.SHT_PROGBITS, flags: textFlags, addr: tc.base + uint32(tc.entry), data: le(storeProg)},
+				{name: ".data", typ: elf.SHT_PROGBITS, flags: dataFlags, addr: 0x100, data: []byte{1, 2, 3, 4}},
+				{name: ".bss", typ: elf.SHT_NOBITS, flags: dataFlags, addr: 0x200, size: 8},
+				{name: ".shared", typ: elf.SHT_PROGBITS, flags: dataFlags, addr: am3xxSharedRam, data: []byte{5, 6}},
+			})
+			entry, err := u.LoadELF(bytes.NewReader(f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry != tc.entry {
+				t.Errorf("entry: got %#x, want %#x", entry, tc.entry)
+			}
+			if got := iram(u, tc.entry, 3); !reflect.DeepEqual(got, storeProg) {
+				t.Errorf("IRAM: got %08x, want %08x", got, storeProg)
+			}
+			if got := u.Ram[0x100:0x104]; !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+				t.Errorf(".data: got %v", got)
+			}
+			if got := u.Ram[0x200:0x208]; !bytes.Equal(got, make([]byte, 8)) {
+				t.Errorf(".bss not cleared: %v", got)
+			}
+			if got := p.SharedRam[0:2]; !bytes.Equal(got, []byte{5, 6}) {
+				t.Errorf(".shared: got %v", got)
+			}
+			if err := u.RunAt(entry); err != nil {
+				t.Fatal(err)
+			}
+			waitHalt(t, u)
+			if v := p.Order.Uint32(u.Ram[0:]); v != 0x1234 {
+				t.Errorf("RAM[0]: got %#x, want %#x", v, 0x1234)
+			}
+		})
+	}
+}
+
+func TestLoadELFFile(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(1)
+	f := filepath.Join(t.TempDir(), "prog.out")
+	b := buildELF(8, []elfSection{
+		{name: ".text", typ: elf.SHT_PROGBITS, flags: textFlags, addr: 8, data: le(storeProg)},
+	})
+	if err := os.WriteFile(f, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.LoadAndRunELFFile(f); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u)
+	if v := p.Order.Uint32(u.Ram[0:]); v != 0x1234 {
+		t.Errorf("RAM[0]: got %#x, want %#x", v, 0x1234)
+	}
+	if _, err := u.LoadELFFile(filepath.Join(t.TempDir(), "missing.out")); err == nil {
+		t.Errorf("missing file: expected error")
+	}
+}
+
+func TestLoadELFInvalid(t *testing.T) {
+	text := func(addr uint32, data []byte) elfSection {
+		return elfSection{name: ".text", typ: elf.SHT_PROGBITS, flags: textFlags, addr: addr, data: data}
+	}
+	data := func(addr uint32, size int) elfSection {
+		return elfSection{name: ".data", typ: elf.SHT_PROGBITS, flags: dataFlags, addr: addr, data: make([]byte, size)}
+	}
+	prog := le(storeProg)
+	valid := buildELF(0, []elfSection{text(0, prog)})
+	tests := []struct {
+		name string
+		elf  []byte
+	}{
+		{"empty", nil},
+		{"not ELF", []byte("not an ELF file, but long enough to be read as a header....")},
+		{"truncated", valid[:len(valid)/2]},
+		{"wrong machine", func() []byte {
+			b := append([]byte(nil), valid...)
+			binary.LittleEndian.PutUint16(b[18:], uint16(elf.EM_ARM))
+			return b
+		}()},
+		{"unaligned entry", buildELF(2, []elfSection{text(0, prog)})},
+		{"entry beyond IRAM", buildELF(am3xxIRamSize, []elfSection{text(0, prog)})},
+		{"GNU entry beyond IRAM", buildELF(gnuIRamBase+am3xxIRamSize, []elfSection{text(gnuIRamBase, prog)})},
+		{"unaligned code address", buildELF(0, []elfSection{text(2, prog)})},
+		{"unaligned code size", buildELF(0, []elfSection{text(0, prog[:6])})},
+		{"code too large", buildELF(0, []elfSection{text(0, make([]byte, am3xxIRamSize+4))})},
+		{"code beyond IRAM", buildELF(0, []elfSection{text(am3xxIRamSize-4, prog)})},
+		{"code address beyond IRAM", buildELF(0, []elfSection{text(am3xxIRamSize, prog)})},
+		{"GNU code beyond IRAM", buildELF(gnuIRamBase, []elfSection{text(gnuIRamBase+am3xxIRamSize-4, prog)})},
+		{"data not in RAM", buildELF(0, []elfSection{text(0, prog), data(0x5000, 4)})},
+		{"data too large", buildELF(0, []elfSection{text(0, prog), data(am3xxRamSize-2, 4)})},
+		{"data beyond end of file", func() []byte {
+			b := buildELF(0, []elfSection{text(0, prog), data(0x100, 4)})
+			// Move the data of the .data section beyond the end of the file.
+			shoff := binary.LittleEndian.Uint32(b[32:])
+			binary.LittleEndian.PutUint32(b[shoff+2*40+16:], uint32(len(b)))
+			return b
+		}()},
+		{"data beyond shared RAM", buildELF(0, []elfSection{text(0, prog), data(am3xxSharedRam+am3xxSharedRamSize-2, 4)})},
+	}
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	fill := []uint32{0xAAAAAAAA, 0xBBBBBBBB, 0xCCCCCCCC}
+	for _, tc := range tests {
+		if err := u.LoadAt(fill, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := u.LoadELF(bytes.NewReader(tc.elf)); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+		// Nothing is loaded if the executable is invalid.
+		if got := iram(u, 0, 3); !reflect.DeepEqual(got, fill) {
+			t.Errorf("%s: IRAM changed: %08x", tc.name, got)
+		}
+	}
+}
@@ -15,30 +15,226 @@
 package pru
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 )
 
+// ErrClosed is returned when waiting on an event after the PRU has been closed.
+var ErrClosed = errors.New("PRU closed")
+
+// OverflowPolicy selects how a received event is handled when the event's queue is full.
+type OverflowPolicy int
+
+const (
+	DropNewest OverflowPolicy = iota // Discard the received event (the default)
+	DropOldest                       // Discard the oldest queued event
+	Block                            // Hold the event until it can be queued (up to the queue depth)
+)
+
+// Default depth of the event queue.
+const defaultQueueDepth = 50
+
+// EventStats contains the delivery statistics of an event.
+// Each received event is counted as either delivered, dropped or pending, so that
+// Delivered + Dropped + Pending equals Received.
+type EventStats struct {
+	Received  uint64    // Events received from the device
+	Delivered uint64    // Events queued for Wait or the handler (and not later discarded)
+	Dropped   uint64    // Events discarded because the queue (and for Block, the pending events) was full
+	Pending   uint64    // Events held until there is space in the queue (Block policy)
+	Last      time.Time // Time that the last event was received
+}
+
+// EventInfo describes a received event.
+type EventInfo struct {
+	Event   int       // System event
+	HostInt int       // Host interrupt that signalled the event, or -1 for rpmsg events
+	Time    time.Time // Time that the event was received
+	Seq     uint64    // Sequence number of the event, starting at 1
+	order   uint64    // Order of delivery across all events
+}
+
 // Event handles waiting on or receiving system events.
 type Event struct {
 	handlerRegistered bool
-	evChan            chan bool
+	evChan            chan EventInfo
 	stopChan          chan bool
+	done              chan struct{} // Closed when the PRU is closed
 	wg                sync.WaitGroup
 	hostInt           uint32
+	policy            OverflowPolicy
+	mu                sync.Mutex // Protects stats, held, pending and forwarding
+	stats             EventStats
+	held              *EventInfo  // Event read by an EventSet but not yet returned
+	pending           []EventInfo // Events waiting to be queued (Block policy)
+	forwarding        bool        // Set if the forward goroutine has been started
+	wake              chan struct{}
 }
 
 // newEvent creates and initialises an Event structure.
-func newEvent() *Event {
+func newEvent(depth int, policy OverflowPolicy) *Event {
 	ev := new(Event)
-	ev.evChan = make(chan bool, 50)
+	ev.evChan = make(chan EventInfo, depth)
+	ev.done = make(chan struct{})
+	ev.policy = policy
+	ev.wake = make(chan struct{}, 1)
 	return ev
 }
 
+// Stats returns the delivery statistics of the event.
+func (e *Event) Stats() EventStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stats
+}
+
+// deliver queues a received event according to the overflow policy.
+// If the policy is Block and the queue is full, the event is passed to a separate
+// goroutine that waits until the event can be queued, so that the caller (the goroutine
+// reading the event devices) is not blocked. The number of pending events is
+// limited to the queue depth, and events received once that limit is reached are dropped.
+func (e *Event) deliver(info EventInfo) {
+	e.mu.Lock()
+	e.stats.Received++
+	e.stats.Last = info.Time
+	info.Seq = e.stats.Received
+	if e.policy == Block {
+		if len(e.pending) == 0 {
+			// Nothing is pending, so the event can be queued directly if there is space.
+			select {
+			case e.evChan <- info:
+				e.stats.Delivered++
+				e.mu.Unlock()
+				return
+			default:
+			}
+		}
+		if len(e.pending) >= cap(e.evChan) {
+			e.stats.Dropped++
+			e.mu.Unlock()
+			return
+		}
+		e.pending = append(e.pending, info)
+		e.stats.Pending++
+		if !e.forwarding {
+			e.forwarding = true
+			go e.forward()
+		}
+		e.mu.Unlock()
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	e.mu.Unlock()
+	var delivered bool
+	switch e.policy {
+	case DropOldest:
+		for !delivered {
+			select {
+			case e.evChan <- info:
+				delivered = true
+			default:
+				// Queue is full, so discard the oldest event.
+				select {
+				case <-e.evChan:
+					// The discarded event was counted as delivered when it was queued.
+					e.mu.Lock()
+					e.stats.Delivered--
+					e.stats.Dropped++
+					e.mu.Unlock()
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case e.evChan <- info:
+			delivered = true
+		default:
+		}
+	}
+	e.mu.Lock()
+	if delivered {
+		e.stats.Delivered++
+	} else {
+		e.stats.Dropped++
+	}
+	e.mu.Unlock()
+}
+
+// forward queues the pending events in the order they were received,
+// waiting for space in the queue, until the PRU is closed.
+func (e *Event) forward() {
+	for {
+		e.mu.Lock()
+		if len(e.pending) == 0 {
+			e.mu.Unlock()
+			select {
+			case <-e.wake:
+				continue
+			case <-e.done:
+				return
+			}
+		}
+		info := e.pending[0]
+		e.mu.Unlock()
+		select {
+		case e.evChan <- info:
+		case <-e.done:
+			return
+		}
+		e.mu.Lock()
+		e.pending = e.pending[1:]
+		e.stats.Pending--
+		e.stats.Delivered++
+		e.mu.Unlock()
+	}
+}
+
+// takeHeld returns the event held by an EventSet, if any.
+func (e *Event) takeHeld() (EventInfo, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.held == nil {
+		return EventInfo{}, false
+	}
+	info := *e.held
+	e.held = nil
+	return info, true
+}
+
+// close releases any goroutines waiting on the event.
+func (e *Event) close() {
+	e.ClearHandler()
+	close(e.done)
+}
+
+// Chan returns the channel that received events are delivered on, for
+// use in select statements. The channel is not closed when the PRU is closed; use Done
+// to detect this. This cannot be used if a handler has been installed on this event.
+func (e *Event) Chan() <-chan EventInfo {
+	return e.evChan
+}
+
+// Done returns a channel that is closed when the PRU is closed.
+func (e *Event) Done() <-chan struct{} {
+	return e.done
+}
+
 // SetHandler installs an asynch handler that is invoked when events are
 // read from the host interrupt device.
 func (e *Event) SetHandler(f func()) {
+	e.SetHandlerFunc(func(EventInfo) { f() })
+}
+
+// SetHandlerFunc installs an asynch handler that is invoked with the
+// details of each event read from the host interrupt device.
+func (e *Event) SetHandlerFunc(f func(EventInfo)) {
 	if e.handlerRegistered {
 		e.ClearHandler()
 	}
@@ -59,16 +255,46 @@ func (e *Event) ClearHandler() {
 }
 
 // Wait reads the event channel and returns the value once available.
+// ErrClosed is returned if the PRU is closed.
 // This cannot be used if a handler has been installed on this event.
 func (e *Event) Wait() error {
 	if e.handlerRegistered {
 		return fmt.Errorf("Handler registered, cannot use Wait")
 	}
-	<-e.evChan
-	return nil
+	if _, ok := e.takeHeld(); ok {
+		return nil
+	}
+	select {
+	case <-e.evChan:
+		return nil
+	case <-e.done:
+		return ErrClosed
+	}
+}
+
+// WaitContext waits for the event, returning the context's error if
+// the context is cancelled or its deadline expires before the event is received,
+// or ErrClosed if the PRU is closed.
+// This cannot be used if a handler has been installed on this event.
+func (e *Event) WaitContext(ctx context.Context) error {
+	if e.handlerRegistered {
+		return fmt.Errorf("Handler registered, cannot use WaitContext")
+	}
+	if _, ok := e.takeHeld(); ok {
+		return nil
+	}
+	select {
+	case <-e.evChan:
+		return nil
+	case <-e.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // WaitTimeout reads the event, returning if the timeout expires.
+// ErrClosed is returned if the PRU is closed.
 // This cannot be used if a handler has been installed on this device e.g
 //  ok, err := e.WaitTimeout(time.Second)
 //  if ok {
@@ -80,12 +306,17 @@ func (e *Event) WaitTimeout(tout time.Duration) (bool, error) {
 	if e.handlerRegistered {
 		return false, fmt.Errorf("Handler registered, cannot use WaitTimeout")
 	}
-	ticker := time.NewTicker(tout)
-	defer ticker.Stop()
+	if _, ok := e.takeHeld(); ok {
+		return true, nil
+	}
+	timer := time.NewTimer(tout)
+	defer timer.Stop()
 	select {
 	case <-e.evChan:
 		return true, nil
-	case <-ticker.C:
+	case <-e.done:
+		return false, ErrClosed
+	case <-timer.C:
 		return false, nil
 	}
 }
@@ -93,19 +324,17 @@ func (e *Event) WaitTimeout(tout time.Duration) (bool, error) {
 // dispatcher is a shim between the channel and the
 // external handler that will be invoked when an event is received.
 // A stop channel is used to indicate when the handler should terminate.
-func (e *Event) dispatcher(f func()) {
+func (e *Event) dispatcher(f func(EventInfo)) {
+	if info, ok := e.takeHeld(); ok {
+		f(info)
+	}
 	for {
 		select {
 		case <-e.stopChan:
 			e.wg.Done()
 			return
-		case v := <-e.evChan:
-			// Reading a closed channel will return false
-			if v {
-				f()
-			} else {
-				return
-			}
+		case info := <-e.evChan:
+			f(info)
 		}
 	}
 }
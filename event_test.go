@@ -0,0 +1,290 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/pru/sim"
+)
+
+func TestEventWait(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	// Events 18 to 25 are mapped to host interrupts 2 to 9.
+	for se := 18; se < 26; se++ {
+		if err := s.RaiseEvent(se); err != nil {
+			t.Fatal(err)
+		}
+		ok, err := p.Event(se).WaitTimeout(testTimeout)
+		if err != nil || !ok {
+			t.Fatalf("event %d: not received (%v)", se, err)
+		}
+	}
+	if ok, _ := p.Event(18).WaitTimeout(10 * time.Millisecond); ok {
+		t.Errorf("event 18 received twice")
+	}
+	p.SendEvent(19)
+	if err := p.Event(19).Wait(); err != nil {
+		t.Fatalf("event 19: %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	ch := make(chan int, 10)
+	for se := 18; se < 26; se++ {
+		se := se
+		p.Event(se).SetHandler(func() {
+			ch <- se
+		})
+	}
+	for se := 18; se < 26; se++ {
+		if err := s.RaiseEvent(se); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each handler is invoked from a separate goroutine, so the events may be handled in any order.
+	seen := make(map[int]bool)
+	for len(seen) < 8 {
+		select {
+		case se := <-ch:
+			if seen[se] {
+				t.Errorf("event %d handled twice", se)
+			}
+			seen[se] = true
+		case <-time.After(testTimeout):
+			t.Fatalf("handlers not invoked (events %v received)", seen)
+		}
+	}
+	if err := p.Event(18).Wait(); err == nil {
+		t.Errorf("Wait with handler: expected error")
+	}
+	p.Event(18).ClearHandler()
+	p.SendEvent(18)
+	if ok, err := p.Event(18).WaitTimeout(testTimeout); err != nil || !ok {
+		t.Errorf("event 18 after ClearHandler: not received (%v)", err)
+	}
+}
+
+func TestClearEvent(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	// Disable the host interrupt so that the event remains pending.
+	p.wr(rHIDISR, 2)
+	p.SendEvent(18)
+	if !s.HostInterrupt(2) {
+		t.Fatalf("event 18 is not pending")
+	}
+	if err := p.ClearEvent(18); err != nil {
+		t.Fatal(err)
+	}
+	if s.HostInterrupt(2) {
+		t.Errorf("event 18 is pending after ClearEvent")
+	}
+	if ok, _ := p.Event(18).WaitTimeout(10 * time.Millisecond); ok {
+		t.Errorf("cleared event was delivered")
+	}
+	// The host interrupt is re-enabled, so the event is received when sent again.
+	p.SendEvent(18)
+	if ok, err := p.Event(18).WaitTimeout(testTimeout); err != nil || !ok {
+		t.Errorf("event 18 after ClearEvent: not received (%v)", err)
+	}
+	if err := p.ClearEvent(40); err == nil {
+		t.Errorf("ClearEvent of unconfigured event: expected error")
+	}
+}
+
+// TestFanOut checks that the events mapped to a shared channel and host interrupt
+// are each received once.
+func TestFanOut(t *testing.T) {
+	pc := NewConfig().EnableUnit(0).Channel2Interrupt(2, 2)
+	for se := 20; se < 24; se++ {
+		pc.Event2Channel(se, 2)
+	}
+	s, p := openSim(t, pc)
+	for se := 20; se < 24; se++ {
+		if err := s.RaiseEvent(se); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for se := 20; se < 24; se++ {
+		if ok, err := p.Event(se).WaitTimeout(testTimeout); err != nil || !ok {
+			t.Fatalf("event %d: not received (%v)", se, err)
+		}
+		if ok, _ := p.Event(se).WaitTimeout(time.Millisecond); ok {
+			t.Errorf("event %d received twice", se)
+		}
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	pc := NewConfig().EnableUnit(0).Event2Channel(18, 2).Channel2Interrupt(2, 2).EventQueue(18, 2, DropOldest)
+	s, p := openSim(t, pc)
+	e := p.Event(18)
+	for i := 1; i <= 5; i++ {
+		s.RaiseEvent(18)
+		waitReceived(t, e, uint64(i))
+	}
+	if st := e.Stats(); st.Received != 5 || st.Delivered != 2 || st.Dropped != 3 {
+		t.Errorf("stats: got %+v", st)
+	}
+	for seq := uint64(4); seq <= 5; seq++ {
+		if info := <-e.Chan(); info.Seq != seq {
+			t.Errorf("got sequence %d, want %d", info.Seq, seq)
+		}
+	}
+}
+
+func TestBlock(t *testing.T) {
+	pc := NewConfig().EnableUnit(0).Channel2Interrupt(3, 3)
+	pc.Event2Channel(16, 3).Event2Channel(17, 3).EventQueue(16, 2, Block)
+	s, p := openSim(t, pc)
+	e := p.Event(16)
+	for i := 1; i <= 5; i++ {
+		s.RaiseEvent(16)
+		waitReceived(t, e, uint64(i))
+	}
+	// Event 16's queue is full, which must not delay event 17.
+	s.RaiseEvent(17)
+	if ok, err := p.Event(17).WaitTimeout(testTimeout); err != nil || !ok {
+		t.Fatalf("event 17: not received (%v)", err)
+	}
+	// Two events are queued and two held, and the fifth is dropped.
+	if st := e.Stats(); st.Received != 5 || st.Delivered != 2 || st.Pending != 2 || st.Dropped != 1 {
+		t.Errorf("stats: got %+v", st)
+	}
+	for seq := uint64(1); seq <= 4; seq++ {
+		select {
+		case info := <-e.Chan():
+			if info.Seq != seq {
+				t.Errorf("got sequence %d, want %d", info.Seq, seq)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("event %d not delivered", seq)
+		}
+	}
+	// Once the pending events are queued, events are held again.
+	for i := 6; i <= 9; i++ {
+		s.RaiseEvent(16)
+		waitReceived(t, e, uint64(i))
+	}
+	if st := e.Stats(); st.Delivered != 6 || st.Pending != 2 || st.Dropped != 1 {
+		t.Errorf("stats: got %+v", st)
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	e := p.Event(18)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := e.WaitContext(ctx); err != context.Canceled {
+		t.Errorf("cancelled: got %v, want %v", err, context.Canceled)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := e.WaitContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("deadline: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := s.RaiseEvent(18); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := e.WaitContext(ctx); err != nil {
+		t.Errorf("event: got %v", err)
+	}
+	e.SetHandler(func() {})
+	if err := e.WaitContext(ctx); err == nil {
+		t.Errorf("WaitContext with a handler: expected error")
+	}
+}
+
+func TestClosed(t *testing.T) {
+	s := sim.New()
+	p, err := OpenWithBackend(DefaultConfig, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := p.Event(18)
+	done := make(chan error)
+	go func() {
+		done <- e.Wait()
+	}()
+	p.Close()
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("Wait: got %v, want ErrClosed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("Wait not released by Close")
+	}
+	if err := e.WaitContext(context.Background()); err != ErrClosed {
+		t.Errorf("WaitContext after Close: got %v, want ErrClosed", err)
+	}
+	if _, err := e.WaitTimeout(time.Millisecond); err != ErrClosed {
+		t.Errorf("WaitTimeout after Close: got %v, want ErrClosed", err)
+	}
+	select {
+	case <-e.Done():
+	default:
+		t.Errorf("Done not closed by Close")
+	}
+}
+
+func TestEventInfo(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	e := p.Event(18)
+	start := time.Now()
+	for seq := uint64(1); seq <= 2; seq++ {
+		if err := s.RaiseEvent(18); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case info := <-e.Chan():
+			if info.Event != 18 || info.HostInt != 2 || info.Seq != seq {
+				t.Errorf("got event %d, host interrupt %d, sequence %d, want 18, 2, %d", info.Event, info.HostInt, info.Seq, seq)
+			}
+			if info.Time.Before(start) || info.Time.After(time.Now()) {
+				t.Errorf("time %v not within the test", info.Time)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("event %d not received", seq)
+		}
+	}
+	// The handler receives the event record.
+	ch := make(chan EventInfo, 1)
+	p.Event(19).SetHandlerFunc(func(info EventInfo) {
+		ch <- info
+	})
+	if err := s.RaiseEvent(19); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-ch:
+		if info.Event != 19 || info.HostInt != 3 || info.Seq != 1 {
+			t.Errorf("handler: got event %d, host interrupt %d, sequence %d, want 19, 3, 1", info.Event, info.HostInt, info.Seq)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("handler not called")
+	}
+	select {
+	case <-e.Done():
+		t.Errorf("Done closed while the PRU is open")
+	default:
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// EventSet allows a single goroutine to wait on any of a set of events.
+// The events in the set should not be waited on by other means (or have
+// a handler installed) while the set is in use.
+type EventSet struct {
+	events []*Event
+	cases  []reflect.SelectCase
+}
+
+// NewEventSet creates an EventSet containing the events identified by ids.
+func (p *PRU) NewEventSet(ids ...int) (*EventSet, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no events in set")
+	}
+	s := new(EventSet)
+	for _, id := range ids {
+		if id < 0 || id >= nEvents || p.events[id] == nil {
+			return nil, fmt.Errorf("Event %d not configured", id)
+		}
+		e := p.events[id]
+		s.events = append(s.events, e)
+		s.cases = append(s.cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(e.evChan)})
+	}
+	// The last 2 cases are the PRU being closed, and the context being done.
+	s.cases = append(s.cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.events[0].done)})
+	s.cases = append(s.cases, reflect.SelectCase{Dir: reflect.SelectRecv})
+	return s, nil
+}
+
+// WaitAny waits for any of the events identified by ids, returning the first event to arrive.
+// It is equivalent to creating an EventSet and calling Wait.
+func (p *PRU) WaitAny(ctx context.Context, ids ...int) (EventInfo, error) {
+	s, err := p.NewEventSet(ids...)
+	if err != nil {
+		return EventInfo{}, err
+	}
+	return s.Wait(ctx)
+}
+
+// Wait waits for any of the events in the set, returning the first event to arrive.
+// If several events have been received, they are returned in the order that
+// they were delivered. The context's error is returned if the context is cancelled
+// or its deadline expires, and ErrClosed if the PRU is closed.
+func (s *EventSet) Wait(ctx context.Context) (EventInfo, error) {
+	for _, e := range s.events {
+		if e.handlerRegistered {
+			return EventInfo{}, fmt.Errorf("Handler registered, cannot use EventSet")
+		}
+	}
+	s.cases[len(s.cases)-1].Chan = reflect.ValueOf(ctx.Done())
+	for {
+		if info, ok := s.first(); ok {
+			return info, nil
+		}
+		i, v, _ := reflect.Select(s.cases)
+		switch i {
+		case len(s.cases) - 2:
+			return EventInfo{}, ErrClosed
+		case len(s.cases) - 1:
+			return EventInfo{}, ctx.Err()
+		}
+		// Hold the received event, so that any earlier event
+		// that has also been received is returned first.
+		info := v.Interface().(EventInfo)
+		e := s.events[i]
+		e.mu.Lock()
+		e.held = &info
+		e.mu.Unlock()
+	}
+}
+
+// first reads the next event of each event in the set without blocking,
+// and returns the earliest delivered event. The events not returned are held
+// so that they are returned by later waits.
+func (s *EventSet) first() (EventInfo, bool) {
+	var earliest *Event
+	var order uint64
+	for _, e := range s.events {
+		e.mu.Lock()
+		if e.held == nil {
+			select {
+			case info := <-e.evChan:
+				e.held = &info
+			default:
+			}
+		}
+		if e.held != nil && (earliest == nil || e.held.order < order) {
+			earliest, order = e, e.held.order
+		}
+		e.mu.Unlock()
+	}
+	if earliest == nil {
+		return EventInfo{}, false
+	}
+	return earliest.takeHeld()
+}
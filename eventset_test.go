@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/pru/sim"
+)
+
+func TestEventSet(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	if _, err := p.NewEventSet(); err == nil {
+		t.Errorf("empty set: expected error")
+	}
+	for _, id := range []int{-1, 5, 64} {
+		if _, err := p.NewEventSet(18, id); err == nil {
+			t.Errorf("event %d: expected error", id)
+		}
+	}
+	set, err := p.NewEventSet(18, 19, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Events are returned in the order that they were delivered.
+	for _, id := range []int{20, 18, 19} {
+		s.RaiseEvent(id)
+		waitReceived(t, p.Event(id), 1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for _, want := range []int{20, 18, 19} {
+		info, err := set.Wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Event != want {
+			t.Errorf("got event %d, want %d", info.Event, want)
+		}
+	}
+	// An event raised while waiting is returned.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.RaiseEvent(19)
+	}()
+	if info, err := p.WaitAny(ctx, 18, 19); err != nil || info.Event != 19 {
+		t.Errorf("WaitAny: got event %d (%v), want 19", info.Event, err)
+	}
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := set.Wait(short); err != context.DeadlineExceeded {
+		t.Errorf("deadline: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	p.Event(20).SetHandler(func() {})
+	if _, err := set.Wait(ctx); err == nil {
+		t.Errorf("Wait with a handler: expected error")
+	}
+}
+
+func TestEventSetClosed(t *testing.T) {
+	p, err := OpenWithBackend(DefaultConfig, sim.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := p.NewEventSet(18, 19)
+	if err != nil {
+		p.Close()
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := set.Wait(context.Background())
+		done <- err
+	}()
+	p.Close()
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("Wait: got %v, want ErrClosed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Wait not released by Close")
+	}
+}
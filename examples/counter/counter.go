@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:generate pasm -b prucounter.p
+//go:generate go run github.com/aamcrae/pru/cmd/pasm -b prucounter.p
 
 package main
 
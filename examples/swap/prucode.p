@@ -13,8 +13,8 @@
 ; limitations under the License.
 ;
 ; Generate the in-program data by:
-;   pasm -m prucode.p prucode
-;   ../../util/img2go.sh prucode main
+;   go run github.com/aamcrae/pru/cmd/pasm -m prucode.p prucode
+;   go run github.com/aamcrae/pru/cmd/img2go -pkg main prucode.img
 
 .origin 0
 .entrypoint Start
@@ -12,8 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:generate pasm -m prucode.p prucode
-//go:generate img2go.sh prucode main
+//go:generate go run github.com/aamcrae/pru/cmd/pasm -m prucode.p prucode
+//go:generate go run github.com/aamcrae/pru/cmd/img2go prucode.img
 
 package main
 
@@ -0,0 +1,123 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gdb
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// interrupt is the packet passed to the server when gdb sends a break (Ctrl-C).
+const interrupt = "\x03"
+
+// conn handles the packet framing of a connection to gdb.
+// A reader goroutine passes the received packets to the server via a channel,
+// so that an interrupt can be received while the unit is running.
+type conn struct {
+	rw    io.ReadWriter
+	mu    sync.Mutex // Serialises writes and protects noAck
+	noAck bool       // Set once gdb has started no acknowledgement mode
+	pkts  chan string
+	err   error // Read error, valid once pkts is closed
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	c := &conn{rw: rw, pkts: make(chan string, 4)}
+	go c.reader()
+	return c
+}
+
+// reader reads packets from gdb, acknowledging them and passing them
+// to the packet channel. The channel is closed when the read fails.
+func (c *conn) reader() {
+	defer close(c.pkts)
+	r := bufio.NewReader(c.rw)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			c.err = err
+			return
+		}
+		switch b {
+		case interrupt[0]:
+			c.pkts <- interrupt
+		case '$':
+			data, err := r.ReadString('#')
+			if err != nil {
+				c.err = err
+				return
+			}
+			data = data[:len(data)-1]
+			var cs [2]byte
+			if _, err := io.ReadFull(r, cs[:]); err != nil {
+				c.err = err
+				return
+			}
+			if c.acking() {
+				var sum uint8
+				if _, err := fmt.Sscanf(string(cs[:]), "%02x", &sum); err != nil || sum != checksum(data) {
+					c.write("-")
+					continue
+				}
+				c.write("+")
+			}
+			c.pkts <- data
+		}
+		// Acknowledgements from gdb are ignored.
+	}
+}
+
+// acking returns true if received packets are to be acknowledged.
+func (c *conn) acking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.noAck
+}
+
+// stopAcks stops the acknowledgement of received packets.
+func (c *conn) stopAcks() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.noAck = true
+}
+
+// send sends a packet to gdb.
+func (c *conn) send(data string) error {
+	return c.write(fmt.Sprintf("$%s#%02x", data, checksum(data)))
+}
+
+func (c *conn) write(s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := io.WriteString(c.rw, s)
+	return err
+}
+
+// checksum returns the modulo 256 sum of the packet data.
+func checksum(s string) uint8 {
+	var sum uint8
+	for i := 0; i < len(s); i++ {
+		sum += s[i]
+	}
+	return sum
+}
+
+// decodeHex decodes a string of hex byte values.
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(s)
+}
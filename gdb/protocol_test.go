@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gdb
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readN reads n bytes from the connection.
+func readN(t *testing.T, r io.Reader, n int) string {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// packet returns the packet received by the conn.
+func packet(t *testing.T, c *conn) string {
+	t.Helper()
+	select {
+	case pkt, ok := <-c.pkts:
+		if !ok {
+			t.Fatalf("connection closed: %v", c.err)
+		}
+		return pkt
+	case <-time.After(time.Second):
+		t.Fatal("no packet received")
+	}
+	return ""
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		data string
+		sum  uint8
+	}{
+		{"", 0},
+		{"g", 0x67},
+		{"qSupported", 0x37},
+		{"m20000000,4", 0x4f},
+	}
+	for _, tc := range tests {
+		if sum := checksum(tc.data); sum != tc.sum {
+			t.Errorf("checksum(%q): got %02x, want %02x", tc.data, sum, tc.sum)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	gdb, stub := net.Pipe()
+	defer gdb.Close()
+	c := newConn(stub)
+	// Valid packet is acknowledged and passed on.
+	go io.WriteString(gdb, "$g#67")
+	if ack := readN(t, gdb, 1); ack != "+" {
+		t.Errorf("ack: got %q, want +", ack)
+	}
+	if pkt := packet(t, c); pkt != "g" {
+		t.Errorf("packet: got %q, want g", pkt)
+	}
+	// Packet with a bad checksum is rejected.
+	go io.WriteString(gdb, "$g#00")
+	if ack := readN(t, gdb, 1); ack != "-" {
+		t.Errorf("bad checksum: got %q, want -", ack)
+	}
+	// Acknowledgements from gdb are ignored, and the interrupt is passed on.
+	go io.WriteString(gdb, "+\x03")
+	if pkt := packet(t, c); pkt != interrupt {
+		t.Errorf("packet: got %q, want interrupt", pkt)
+	}
+	// Replies are framed with the checksum.
+	go c.send("OK")
+	if r := readN(t, gdb, 6); r != "$OK#9a" {
+		t.Errorf("reply: got %q, want $OK#9a", r)
+	}
+	// No acknowledgement mode, where the checksum is not checked.
+	c.stopAcks()
+	go io.WriteString(gdb, "$m0,4#00")
+	if pkt := packet(t, c); pkt != "m0,4" {
+		t.Errorf("packet: got %q, want m0,4", pkt)
+	}
+	// The channel is closed when the connection is closed.
+	gdb.Close()
+	select {
+	case _, ok := <-c.pkts:
+		if ok {
+			t.Errorf("unexpected packet")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed")
+	}
+	if c.err == nil {
+		t.Errorf("expected read error")
+	}
+}
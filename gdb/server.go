@@ -0,0 +1,520 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gdb implements a stub for the GDB remote serial protocol, so that a
+// PRU unit can be debugged using gdb (e.g gdb-multiarch) e.g
+//
+//	s, err := gdb.NewServer(p, 0)
+//	...
+//	err = s.ListenAndServe("localhost:2345")
+//
+// and in gdb:
+//
+//	(gdb) set architecture pru
+//	(gdb) target remote localhost:2345
+//
+// The registers r0 to r31 are accessed via the unit's debug registers, and
+// the PC (register 32) is the byte address of the current instruction
+// in the instruction memory space. Instruction memory (IRAM) is accessed at
+// the IMem address (default 0x20000000, as used by the GNU PRU toolchain, or 0
+// for programs built with clpru), and data memory uses the unit's memory map, where
+// address 0 is the unit's data RAM, 0x2000 is the other unit's data RAM (if that unit
+// is enabled) and 0x10000 is the shared RAM. Instruction and data memory are separate
+// address spaces: the PC and breakpoint addresses are always instruction addresses,
+// and may be given either relative to IMem or as the IRAM byte address, whereas memory
+// reads and writes of addresses in the data memory map access data memory, so if IMem
+// is 0, IRAM is not accessible via memory reads and writes. Software breakpoints are implemented by replacing the instruction
+// with HALT while the unit is running, and single step uses the unit's
+// single step mode.
+package gdb
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aamcrae/pru"
+	"github.com/aamcrae/pru/internal/breakpoint"
+)
+
+const (
+	iramSize     = 8 * 1024
+	ramSize      = 8 * 1024
+	otherRam     = 0x2000
+	sharedRam    = 0x10000
+	pcReg        = 32 // GDB register number of PC
+	nRegs        = 33
+	pollInterval = 10 * time.Millisecond
+)
+
+// GDB signal numbers used in stop replies.
+const (
+	sigInt  = 2
+	sigTrap = 5
+)
+
+// Server serves the GDB remote serial protocol for a PRU unit.
+type Server struct {
+	IMem uint32 // GDB address of the start of IRAM.
+
+	p     *pru.PRU
+	u     *pru.Unit
+	index int
+	mu    sync.Mutex // Serialises connections
+	bps   *breakpoint.Set
+}
+
+// NewServer creates a GDB server for the unit, which must be enabled.
+func NewServer(p *pru.PRU, unit int) (*Server, error) {
+	if unit != 0 && unit != 1 {
+		return nil, fmt.Errorf("invalid unit %d", unit)
+	}
+	u := p.Unit(unit)
+	if u == nil {
+		return nil, fmt.Errorf("unit %d is not enabled", unit)
+	}
+	return &Server{IMem: 0x20000000, p: p, u: u, index: unit, bps: breakpoint.New(u)}, nil
+}
+
+// ListenAndServe listens on the TCP address, and serves connections
+// from gdb one at a time.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(l)
+}
+
+// Serve accepts connections from the listener and serves them one at a time,
+// returning when the listener returns an error.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.ServeConn(c)
+		c.Close()
+	}
+}
+
+// ServeConn serves a single gdb connection until gdb detaches or the connection is closed.
+// The unit is halted when gdb connects.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.u.Halt()
+	c := newConn(rw)
+	for {
+		pkt, ok := <-c.pkts
+		if !ok {
+			return c.err
+		}
+		if pkt == interrupt {
+			// Unit is already halted.
+			continue
+		}
+		reply, done := s.handle(c, pkt)
+		if err := c.send(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// handle processes one packet, returning the reply and whether the
+// connection should be closed.
+func (s *Server) handle(c *conn, pkt string) (string, bool) {
+	if pkt == "" {
+		return "", false
+	}
+	args := pkt[1:]
+	switch pkt[0] {
+	case '?':
+		return stopReply(sigTrap), false
+	case 'g':
+		return s.readRegs(), false
+	case 'G':
+		return s.writeRegs(args), false
+	case 'p':
+		return s.readReg(args), false
+	case 'P':
+		return s.writeReg(args), false
+	case 'm':
+		return s.readMem(args), false
+	case 'M':
+		return s.writeMem(args), false
+	case 'c':
+		return s.cont(c, args), false
+	case 's':
+		return s.step(args), false
+	case 'Z', 'z':
+		return s.breakpoint(pkt[0] == 'Z', args), false
+	case 'H', 'T':
+		return "OK", false
+	case 'D':
+		s.bps.Remove()
+		return "OK", true
+	case 'k':
+		s.u.Halt()
+		return "", true
+	case 'q':
+		return s.query(args), false
+	case 'Q':
+		if args == "StartNoAckMode" {
+			c.stopAcks()
+			return "OK", false
+		}
+	}
+	// Empty reply for unsupported packets.
+	return "", false
+}
+
+// query handles the general query packets.
+func (s *Server) query(q string) string {
+	switch {
+	case len(q) >= 9 && q[:9] == "Supported":
+		return "PacketSize=1000;QStartNoAckMode+"
+	case q == "Attached":
+		return "1"
+	case q == "C":
+		return "QC1"
+	case q == "fThreadInfo":
+		return "m1"
+	case q == "sThreadInfo":
+		return "l"
+	}
+	return ""
+}
+
+// stopReply returns the reply sent when the unit stops.
+func stopReply(sig int) string {
+	return fmt.Sprintf("S%02x", sig)
+}
+
+// pc returns the PC as a GDB address.
+func (s *Server) pc() uint32 {
+	return s.IMem + uint32(s.u.PC())
+}
+
+// iramAddr converts a GDB instruction address to an IRAM byte address.
+// The address may be relative to IMem, or the IRAM byte address (as used
+// by programs linked with IRAM at 0).
+func (s *Server) iramAddr(a uint32) (uint32, error) {
+	if a >= s.IMem && a-s.IMem < iramSize {
+		a -= s.IMem
+	}
+	if a >= iramSize || a%4 != 0 {
+		return 0, fmt.Errorf("invalid instruction address 0x%x", a)
+	}
+	return a, nil
+}
+
+// iramOffset returns the IRAM byte offset of a GDB memory address, and
+// false if the address is not in IRAM. Addresses in the data memory map
+// are data memory, even if they are also in the IRAM address range.
+func (s *Server) iramOffset(a uint32) (uint32, bool) {
+	if a < s.IMem || a-s.IMem >= iramSize || s.isData(a) {
+		return 0, false
+	}
+	return a - s.IMem, true
+}
+
+// isData returns true if the address is in the unit's data memory map.
+func (s *Server) isData(a uint32) bool {
+	return a < ramSize || (a >= otherRam && a < otherRam+ramSize) ||
+		(a >= sharedRam && a < sharedRam+uint32(len(s.p.SharedRam)))
+}
+
+// readRegs returns all the registers.
+func (s *Server) readRegs() string {
+	r, err := s.u.Registers()
+	if err != nil {
+		return "E01"
+	}
+	var b []byte
+	for _, v := range r {
+		b = s.appendWord(b, v)
+	}
+	b = s.appendWord(b, s.pc())
+	return fmt.Sprintf("%x", b)
+}
+
+// writeRegs writes all the registers.
+func (s *Server) writeRegs(args string) string {
+	b, err := decodeHex(args)
+	if err != nil || len(b) < 32*4 {
+		return "E01"
+	}
+	for i := 0; i < 32; i++ {
+		if err := s.u.SetRegister(i, s.p.Order.Uint32(b[i*4:])); err != nil {
+			return "E01"
+		}
+	}
+	if len(b) >= nRegs*4 {
+		return s.setPC(s.p.Order.Uint32(b[pcReg*4:]))
+	}
+	return "OK"
+}
+
+// readReg returns a single register.
+func (s *Server) readReg(args string) string {
+	var n int
+	if _, err := fmt.Sscanf(args, "%x", &n); err != nil || n < 0 || n >= nRegs {
+		return "E01"
+	}
+	var v uint32
+	if n == pcReg {
+		v = s.pc()
+	} else {
+		var err error
+		if v, err = s.u.Register(n); err != nil {
+			return "E01"
+		}
+	}
+	return fmt.Sprintf("%x", s.appendWord(nil, v))
+}
+
+// writeReg writes a single register.
+func (s *Server) writeReg(args string) string {
+	var n int
+	var h string
+	if _, err := fmt.Sscanf(args, "%x=%s", &n, &h); err != nil || n < 0 || n >= nRegs {
+		return "E01"
+	}
+	b, err := decodeHex(h)
+	if err != nil || len(b) != 4 {
+		return "E01"
+	}
+	v := s.p.Order.Uint32(b)
+	if n == pcReg {
+		return s.setPC(v)
+	}
+	if err := s.u.SetRegister(n, v); err != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+// setPC sets the PC of the halted unit.
+func (s *Server) setPC(v uint32) string {
+	if v == s.pc() {
+		return "OK"
+	}
+	a, err := s.iramAddr(v)
+	if err != nil {
+		return "E01"
+	}
+	if err := s.u.SetPC(uint(a)); err != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+// memory returns the memory at the GDB address. IRAM is returned as a copy.
+func (s *Server) memory(a, n uint32) ([]byte, error) {
+	if offs, ok := s.iramOffset(a); ok {
+		if n > iramSize-offs {
+			return nil, fmt.Errorf("invalid length")
+		}
+		start := offs &^ 3
+		end := (offs + n + 3) &^ 3
+		code, err := s.u.ReadIRAM(uint(start), uint(end-start)/4)
+		if err != nil {
+			return nil, err
+		}
+		var b []byte
+		for _, w := range code {
+			b = s.appendWord(b, w)
+		}
+		return b[offs-start : offs-start+n], nil
+	}
+	var mem []byte
+	var base uint32
+	switch {
+	case a < ramSize:
+		mem = s.u.Ram
+	case a >= otherRam && a < otherRam+ramSize:
+		o := s.p.Unit(1 - s.index)
+		if o == nil {
+			return nil, fmt.Errorf("unit not enabled")
+		}
+		mem, base = o.Ram, otherRam
+	case a >= sharedRam && a < sharedRam+uint32(len(s.p.SharedRam)):
+		mem, base = s.p.SharedRam, sharedRam
+	default:
+		return nil, fmt.Errorf("invalid address")
+	}
+	if n > uint32(len(mem))-(a-base) {
+		return nil, fmt.Errorf("invalid length")
+	}
+	return mem[a-base : a-base+n], nil
+}
+
+// readMem reads memory.
+func (s *Server) readMem(args string) string {
+	var a, n uint32
+	if _, err := fmt.Sscanf(args, "%x,%x", &a, &n); err != nil {
+		return "E01"
+	}
+	b, err := s.memory(a, n)
+	if err != nil {
+		return "E01"
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// writeMem writes memory. Writes to IRAM are written as whole words.
+func (s *Server) writeMem(args string) string {
+	var a, n uint32
+	var h string
+	if _, err := fmt.Sscanf(args, "%x,%x:%s", &a, &n, &h); err != nil {
+		if _, err := fmt.Sscanf(args, "%x,%x:", &a, &n); err != nil || n != 0 {
+			return "E01"
+		}
+	}
+	data, err := decodeHex(h)
+	if err != nil || uint32(len(data)) != n {
+		return "E01"
+	}
+	if offs, ok := s.iramOffset(a); ok {
+		// Read the words containing the data, and rewrite them.
+		start := offs &^ 3
+		b, err := s.memory(s.IMem+start, (offs+n+3)&^3-start)
+		if err != nil {
+			return "E01"
+		}
+		copy(b[offs-start:], data)
+		code := make([]uint32, len(b)/4)
+		for i := range code {
+			code[i] = s.p.Order.Uint32(b[i*4:])
+		}
+		if err := s.u.LoadAt(code, uint(start)); err != nil {
+			return "E01"
+		}
+		return "OK"
+	}
+	b, err := s.memory(a, n)
+	if err != nil {
+		return "E01"
+	}
+	copy(b, data)
+	return "OK"
+}
+
+// breakpoint inserts or removes a software breakpoint.
+func (s *Server) breakpoint(insert bool, args string) string {
+	var t int
+	var a, kind uint32
+	if _, err := fmt.Sscanf(args, "%x,%x,%x", &t, &a, &kind); err != nil {
+		return "E01"
+	}
+	if t != 0 {
+		// Only software breakpoints are supported.
+		return ""
+	}
+	offs, err := s.iramAddr(a)
+	if err != nil {
+		return "E01"
+	}
+	if insert {
+		if err := s.bps.Add(uint(offs)); err != nil {
+			return "E01"
+		}
+	} else {
+		s.bps.Delete(uint(offs))
+	}
+	return "OK"
+}
+
+// resumeAddr parses the optional resume address of the continue and step packets.
+func (s *Server) resumeAddr(args string) error {
+	if args == "" {
+		return nil
+	}
+	var a uint32
+	if _, err := fmt.Sscanf(args, "%x", &a); err != nil {
+		return err
+	}
+	if r := s.setPC(a); r != "OK" {
+		return fmt.Errorf("invalid address")
+	}
+	return nil
+}
+
+// cont continues execution until the unit halts, or gdb sends an interrupt.
+func (s *Server) cont(c *conn, args string) string {
+	if err := s.resumeAddr(args); err != nil {
+		return "E01"
+	}
+	if err := s.bps.Resume(); err != nil {
+		return "E01"
+	}
+	sig := sigTrap
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for s.u.IsRunning() {
+		select {
+		case pkt, ok := <-c.pkts:
+			if !ok {
+				// Connection closed.
+				s.u.Halt()
+				s.bps.Remove()
+				return ""
+			}
+			if pkt == interrupt {
+				s.u.Halt()
+				sig = sigInt
+			}
+		case <-t.C:
+		}
+	}
+	s.bps.Remove()
+	return stopReply(sig)
+}
+
+// step executes a single instruction.
+func (s *Server) step(args string) string {
+	if err := s.resumeAddr(args); err != nil {
+		return "E01"
+	}
+	if err := s.u.Step(); err != nil {
+		return "E01"
+	}
+	return stopReply(sigTrap)
+}
+
+// appendWord appends the word to the byte slice in the target byte order.
+func (s *Server) appendWord(b []byte, v uint32) []byte {
+	var w [4]byte
+	s.p.Order.PutUint32(w[:], v)
+	return append(b, w[:]...)
+}
+
+// SetPC halts the unit and sets the PC to the byte address in IRAM, so that
+// execution starts at the address when gdb continues or steps the unit, such
+// as the entry point of a loaded program.
+func (s *Server) SetPC(addr uint) error {
+	s.u.Halt()
+	if r := s.setPC(s.IMem + uint32(addr)); r != "OK" {
+		return fmt.Errorf("invalid address 0x%x", addr)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gdb
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/aamcrae/pru"
+	"github.com/aamcrae/pru/sim"
+)
+
+// Test program that stores 0x1234 in the first word of the unit's RAM.
+var storeProg = []uint32{
+	0x241234e1, // LDI r1, 0x1234
+	0xe1002081, // SBBO &r1, r0, 0, 4
+	0x2a000000, // HALT
+}
+
+// client is a minimal gdb client.
+type client struct {
+	t     *testing.T
+	c     net.Conn
+	r     *bufio.Reader
+	noAck bool
+	done  chan error
+}
+
+// serve starts serving a connection for unit 0 of a simulated PRU with the program
+// loaded, returning the server and the gdb client of the connection.
+func serve(t *testing.T, imem uint32) (*Server, *client) {
+	t.Helper()
+	p, err := pru.OpenWithBackend(pru.NewConfig().EnableUnit(0), sim.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	if err := p.Unit(0).LoadAt(storeProg, 0); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.IMem = imem
+	gdb, stub := net.Pipe()
+	c := &client{t: t, c: gdb, r: bufio.NewReader(gdb), done: make(chan error, 1)}
+	go func() {
+		c.done <- s.ServeConn(stub)
+		stub.Close()
+	}()
+	t.Cleanup(func() {
+		gdb.Close()
+		<-c.done
+	})
+	return s, c
+}
+
+// cmd sends the packet and returns the reply.
+func (c *client) cmd(pkt string) string {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.c, "$%s#%02x", pkt, checksum(pkt)); err != nil {
+		c.t.Fatal(err)
+	}
+	if !c.noAck {
+		if b, err := c.r.ReadByte(); err != nil || b != '+' {
+			c.t.Fatalf("%s: no ack (%q, %v)", pkt, b, err)
+		}
+	}
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	reply, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.r.Discard(2); err != nil {
+		c.t.Fatal(err)
+	}
+	return reply[:len(reply)-1]
+}
+
+// expect sends the packet and checks the reply.
+func (c *client) expect(pkt, want string) {
+	c.t.Helper()
+	if reply := c.cmd(pkt); reply != want {
+		c.t.Errorf("%s: got %q, want %q", pkt, reply, want)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	p, err := pru.OpenWithBackend(pru.NewConfig().EnableUnit(0), sim.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := NewServer(p, 1); err == nil {
+		t.Errorf("unit 1 not enabled: expected error")
+	}
+	if _, err := NewServer(p, 2); err == nil {
+		t.Errorf("unit 2: expected error")
+	}
+}
+
+func TestServer(t *testing.T) {
+	_, c := serve(t, 0x20000000)
+	c.expect("qSupported:swbreak+", "PacketSize=1000;QStartNoAckMode+")
+	c.expect("?", "S05")
+	c.expect("QStartNoAckMode", "OK")
+	c.noAck = true
+	c.expect("vMustReplyEmpty", "")
+	// Registers, including the PC at the start of IRAM.
+	c.expect("P1=78563412", "OK")
+	c.expect("p1", "78563412")
+	c.expect("p20", "00000020")
+	c.expect("P20=08000020", "OK")
+	c.expect("p20", "08000020")
+	c.expect("P20=00000000", "OK")
+	c.expect("p20", "00000020")
+	c.expect("P20=02000000", "E01")
+	// Instruction and data memory.
+	c.expect("m20000000,8", "e1341224812000e1")
+	c.expect("m20000002,4", "12248120")
+	c.expect("M0,4:01020304", "OK")
+	c.expect("m0,4", "01020304")
+	c.expect("m20002000,4", "E01")
+	// Breakpoints at IMem relative and IRAM byte addresses.
+	c.expect("Z0,20000004,4", "OK")
+	c.expect("c", "S05")
+	c.expect("p20", "04000020")
+	c.expect("m0,4", "01020304")
+	c.expect("z0,20000004,4", "OK")
+	c.expect("Z0,8,4", "OK")
+	c.expect("c", "S05")
+	c.expect("p20", "08000020")
+	c.expect("m0,4", "34120000")
+	c.expect("Z0,2000,4", "E01")
+	c.expect("Z0,6,4", "E01")
+	c.expect("D", "OK")
+}
+
+func TestServerIMemZero(t *testing.T) {
+	s, c := serve(t, 0)
+	s.u.Ram[0] = 0x55
+	c.expect("p20", "00000000")
+	// Memory at 0 is data memory.
+	c.expect("m0,4", "55000000")
+	c.expect("M4,4:aabbccdd", "OK")
+	if s.u.Ram[4] != 0xaa {
+		t.Errorf("data RAM not written")
+	}
+	// Instruction addresses are in IRAM.
+	c.expect("Z0,4,4", "OK")
+	c.expect("c", "S05")
+	c.expect("p20", "04000000")
+	c.expect("s", "S05")
+	c.expect("p20", "08000000")
+	c.expect("m0,4", "34120000")
+	c.expect("k", "")
+}
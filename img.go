@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadImg parses an image in the format generated by the pasm assembler
+// using the -m option (one 32 bit hex instruction word per line),
+// returning the instruction words.
+func ReadImg(r io.Reader) ([]uint32, error) {
+	var code []uint32
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		w := strings.TrimSpace(s.Text())
+		if len(w) == 0 {
+			continue
+		}
+		if len(w) > 8 {
+			return nil, fmt.Errorf("line %d: %q is not a 32 bit hex word", line, w)
+		}
+		v, err := strconv.ParseUint(w, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %q is not a 32 bit hex word", line, w)
+		}
+		code = append(code, uint32(v))
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if uint(len(code)*4) > am3xxIRamSize {
+		return nil, fmt.Errorf("Program too large")
+	}
+	return code, nil
+}
+
+// ReadImgFile parses the image file generated by the pasm assembler
+// using the -m option.
+func ReadImgFile(s string) ([]uint32, error) {
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	code, err := ReadImg(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s, err)
+	}
+	return code, nil
+}
+
+// LoadImgFile loads the program from an image file to instruction address 0.
+func (u *Unit) LoadImgFile(s string) error {
+	return u.LoadImgFileAt(s, 0)
+}
+
+// LoadImgFileAt loads the program from an image file (as generated by
+// pasm using the -m option) to the address specified.
+func (u *Unit) LoadImgFileAt(s string, addr uint) error {
+	code, err := ReadImgFile(s)
+	if err != nil {
+		return err
+	}
+	return u.LoadAt(code, addr)
+}
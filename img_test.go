@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadImg(t *testing.T) {
+	// Blank lines, surrounding white space and CRLF line endings are accepted.
+	code, err := ReadImg(strings.NewReader("241234e1\n\n  E1002081\t\r\n2a000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(code, storeProg) {
+		t.Errorf("got %08x, want %08x", code, storeProg)
+	}
+	code, err = ReadImg(strings.NewReader(""))
+	if err != nil || len(code) != 0 {
+		t.Errorf("empty image: got %08x (%v)", code, err)
+	}
+}
+
+func TestReadImgInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		img  string
+		line string // Line number reported in the error
+	}{
+		{"too long", "00000000\n123456789\n", "line 2"},
+		{"hex prefix", "0x123456\n", "line 1"},
+		{"not hex", "00000000\n\nxyz\n", "line 3"},
+		{"two words", "1234 5678\n", "line 1"},
+		{"negative", "-1\n", "line 1"},
+		{"too large", strings.Repeat("00000000\n", am3xxIRamSize/4+1), ""},
+	}
+	for _, tc := range tests {
+		_, err := ReadImg(strings.NewReader(tc.img))
+		if err == nil {
+			t.Errorf("%s: expected error", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.line) {
+			t.Errorf("%s: error %q does not contain %q", tc.name, err, tc.line)
+		}
+	}
+}
+
+func TestLoadImgFile(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	dir := t.TempDir()
+	f := filepath.Join(dir, "prog.img")
+	if err := os.WriteFile(f, []byte("241234e1\ne1002081\n2a000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.LoadImgFileAt(f, 0x40); err != nil {
+		t.Fatal(err)
+	}
+	if got := iram(u, 0x40, 3); !reflect.DeepEqual(got, storeProg) {
+		t.Errorf("IRAM: got %08x, want %08x", got, storeProg)
+	}
+	bad := filepath.Join(dir, "bad.img")
+	if err := os.WriteFile(bad, []byte("nothex\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.LoadImgFile(bad); err == nil || !strings.Contains(err.Error(), bad) {
+		t.Errorf("invalid image: got %v, want error naming the file", err)
+	}
+	if err := u.LoadImgFile(filepath.Join(dir, "missing.img")); err == nil {
+		t.Errorf("missing file: expected error")
+	}
+}
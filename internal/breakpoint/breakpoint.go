@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package breakpoint implements the software breakpoints used by the PRU debuggers.
+// Breakpoints are implemented by replacing the instruction with HALT while the unit
+// is running, and restoring the instruction when the unit halts.
+package breakpoint
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aamcrae/pru"
+)
+
+const insHalt = 0x2A000000 // HALT instruction
+
+// Set is the set of breakpoints of a unit. Addresses are IRAM byte addresses.
+type Set struct {
+	u     *pru.Unit
+	addrs map[uint]bool   // Breakpoint addresses
+	saved map[uint]uint32 // Instructions replaced by breakpoints
+}
+
+// New creates an empty set of breakpoints for the unit.
+func New(u *pru.Unit) *Set {
+	return &Set{u: u, addrs: make(map[uint]bool)}
+}
+
+// Add adds a breakpoint at the address.
+func (s *Set) Add(addr uint) error {
+	if _, err := s.u.ReadIRAM(addr, 1); err != nil {
+		return fmt.Errorf("invalid breakpoint address 0x%x: %v", addr, err)
+	}
+	s.addrs[addr] = true
+	return nil
+}
+
+// Delete removes the breakpoint at the address, returning false if there is no breakpoint.
+func (s *Set) Delete(addr uint) bool {
+	if !s.addrs[addr] {
+		return false
+	}
+	delete(s.addrs, addr)
+	return true
+}
+
+// Clear removes all the breakpoints.
+func (s *Set) Clear() {
+	s.addrs = make(map[uint]bool)
+}
+
+// Has returns true if there is a breakpoint at the address.
+func (s *Set) Has(addr uint) bool {
+	return s.addrs[addr]
+}
+
+// List returns the breakpoint addresses in order.
+func (s *Set) List() []uint {
+	var l []uint
+	for a := range s.addrs {
+		l = append(l, a)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	return l
+}
+
+// Insert saves the instructions at the breakpoints, and replaces them with HALT.
+func (s *Set) Insert() error {
+	s.saved = make(map[uint]uint32)
+	for a := range s.addrs {
+		w, err := s.u.ReadIRAM(a, 1)
+		if err != nil {
+			s.Remove()
+			return err
+		}
+		s.saved[a] = w[0]
+		if err := s.u.LoadAt([]uint32{insHalt}, a); err != nil {
+			s.Remove()
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove restores the instructions replaced by breakpoints, returning
+// the first error encountered.
+func (s *Set) Remove() error {
+	var err error
+	for a, w := range s.saved {
+		if lerr := s.u.LoadAt([]uint32{w}, a); lerr != nil && err == nil {
+			err = fmt.Errorf("failed to restore instruction at 0x%04x: %v", a, lerr)
+		}
+	}
+	s.saved = nil
+	return err
+}
+
+// RunAt inserts the breakpoints and runs the unit from the address.
+// Remove must be called once the unit has halted.
+func (s *Set) RunAt(addr uint) error {
+	if err := s.Insert(); err != nil {
+		return err
+	}
+	if err := s.u.RunAt(addr); err != nil {
+		s.Remove()
+		return err
+	}
+	return nil
+}
+
+// Resume inserts the breakpoints and continues execution of the halted unit
+// from the current PC. If there is a breakpoint at the current PC, the instruction
+// is single stepped before the breakpoints are inserted, so that the unit does not
+// halt immediately. Remove must be called once the unit has halted.
+func (s *Set) Resume() error {
+	if s.addrs[s.u.PC()] {
+		if err := s.u.Step(); err != nil {
+			return err
+		}
+	}
+	if err := s.Insert(); err != nil {
+		return err
+	}
+	if err := s.u.Resume(); err != nil {
+		s.Remove()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package breakpoint
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/pru"
+	"github.com/aamcrae/pru/sim"
+)
+
+// Test program that sets r1 to 1, 2 and 3 in turn.
+var prog = []uint32{
+	0x240001e1, // LDI r1, 1
+	0x240002e1, // LDI r1, 2
+	0x240003e1, // LDI r1, 3
+	0x2a000000, // HALT
+}
+
+// open returns unit 0 of a simulated PRU with the program loaded.
+func open(t *testing.T) *pru.Unit {
+	t.Helper()
+	p, err := pru.OpenWithBackend(pru.NewConfig().EnableUnit(0), sim.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	u := p.Unit(0)
+	if err := u.LoadAt(prog, 0); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// halted waits for the unit to halt, and checks the PC and r1.
+func halted(t *testing.T, u *pru.Unit, pc uint, r1 uint32) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for u.IsRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("unit did not halt")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := u.PC(); got != pc {
+		t.Errorf("PC: got %#x, want %#x", got, pc)
+	}
+	if r, err := u.Register(1); err != nil || r != r1 {
+		t.Errorf("r1: got %d (%v), want %d", r, err, r1)
+	}
+}
+
+func TestSet(t *testing.T) {
+	s := New(open(t))
+	for _, a := range []uint{8, 4} {
+		if err := s.Add(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, a := range []uint{2, 0x2000} {
+		if err := s.Add(a); err == nil {
+			t.Errorf("Add(%#x): expected error", a)
+		}
+	}
+	if l := s.List(); !reflect.DeepEqual(l, []uint{4, 8}) {
+		t.Errorf("List: got %v, want [4 8]", l)
+	}
+	if !s.Has(4) || s.Has(0) {
+		t.Errorf("Has: got %v %v, want true false", s.Has(4), s.Has(0))
+	}
+	if !s.Delete(4) || s.Delete(4) {
+		t.Errorf("Delete: expected true then false")
+	}
+	s.Clear()
+	if l := s.List(); len(l) != 0 {
+		t.Errorf("List after Clear: got %v", l)
+	}
+}
+
+func TestRun(t *testing.T) {
+	u := open(t)
+	s := New(u)
+	s.Add(4)
+	s.Add(8)
+	if err := s.RunAt(0); err != nil {
+		t.Fatal(err)
+	}
+	halted(t, u, 4, 1)
+	if err := s.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	// The instructions are restored once the breakpoints are removed.
+	if code, err := u.ReadIRAM(0, uint(len(prog))); err != nil || !reflect.DeepEqual(code, prog) {
+		t.Errorf("IRAM: got %08x (%v), want %08x", code, err, prog)
+	}
+	// Resuming at a breakpoint executes the instruction before halting at the next.
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	halted(t, u, 8, 2)
+	s.Remove()
+	s.Delete(8)
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	halted(t, u, 12, 3)
+	s.Remove()
+	if code, err := u.ReadIRAM(0, uint(len(prog))); err != nil || !reflect.DeepEqual(code, prog) {
+		t.Errorf("IRAM: got %08x (%v), want %08x", code, err, prog)
+	}
+	if err := s.RunAt(2); err == nil {
+		t.Errorf("RunAt unaligned address: expected error")
+	}
+	// Breakpoints are removed when the unit cannot be run.
+	if code, _ := u.ReadIRAM(0, uint(len(prog))); !reflect.DeepEqual(code, prog) {
+		t.Errorf("IRAM after failed RunAt: got %08x, want %08x", code, prog)
+	}
+}
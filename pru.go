@@ -20,19 +20,17 @@ import (
 	"math/bits"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
-
-	"golang.org/x/sys/unix"
 )
 
 // Device paths.
 const (
-	drvMemBase = "/sys/class/uio/uio0/maps/map0/addr"
-	drvMemSize = "/sys/class/uio/uio0/maps/map0/size"
-	drvUioBase = "/dev/uio%d"
-	drvUIO0    = "/dev/uio0"
+	drvUioClass = "/sys/class/uio"
+	drvUioName  = "pruss_evt%d"
+	drvMemSize  = "/sys/class/uio/uio%d/maps/map0/size"
+	drvUioBase  = "/dev/uio%d"
 )
 
 // versions
@@ -89,16 +87,21 @@ const (
 )
 
 type PRU struct {
-	mmapFile *os.File
-	memBase  int
-	memSize  int
+	order    uint64 // Count of delivered events (first for 64 bit alignment of atomic access)
+	backend  Backend
+	rproc    *rprocBackend // Set if the RemoteProc driver is used
 	mem      []byte
 	version  int
 	units    [nUnits]*Unit
-	signals  []*os.File
+	disp     *dispatcher // Reads the event devices
 	events   [nEvents]*Event
 	sigMask  [nSignals]uint64 // System event mask for each signal
 	evMask   uint64           // Global mask for system events
+	verify   bool             // Verify programs loaded into IRAM
+	noReset  bool             // Units are not reset when opened or closed
+	haltPoll time.Duration    // Poll interval for WaitHalt
+	errMu    sync.Mutex       // Protects err
+	err      error            // Failure reading the event devices
 
 	SharedRam ram              // Shared RAM byte array
 	Order     binary.ByteOrder // encoding/binary Order for reading/writing.
@@ -108,29 +111,44 @@ type PRU struct {
 var pru *PRU
 
 // Open initialises the PRU subsystem using the configuration provided.
+// If the PRU cores are managed by the RemoteProc driver, the PRU-ICSS is
+// accessed via /dev/mem and events are delivered via rpmsg devices,
+// otherwise the PRU-ICSS is accessed via the UIO device driver.
 func Open(pc *Config) (*PRU, error) {
 	if pru != nil {
 		return nil, fmt.Errorf("Device already open; must close it first")
 	}
-	p := new(PRU)
+	var b Backend
 	var err error
-	p.memBase, err = readDriverValue(drvMemBase)
-	if err != nil {
-		return nil, err
+	if base, procs, ok := findRprocs(pc.root); ok {
+		b, err = newRprocBackend(pc.root, base, procs)
+	} else {
+		b, err = newUioBackend(pc.root)
 	}
-	p.memSize, err = readDriverValue(drvMemSize)
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.OpenFile(drvUIO0, os.O_RDWR|os.O_SYNC, 0660)
+	p, err := OpenWithBackend(pc, b)
 	if err != nil {
+		b.Close()
 		return nil, err
 	}
-	p.mem, err = unix.Mmap(int(f.Fd()), 0, p.memSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
-	if err != nil {
-		f.Close()
-		return nil, fmt.Errorf("%s: %v", drvUIO0, err)
+	return p, nil
+}
+
+// OpenWithBackend initialises the PRU subsystem using the configuration
+// and backend provided. If successful, the backend is closed when the PRU is closed,
+// otherwise the caller remains responsible for closing the backend.
+func OpenWithBackend(pc *Config, b Backend) (*PRU, error) {
+	if pru != nil {
+		return nil, fmt.Errorf("Device already open; must close it first")
 	}
+	p := new(PRU)
+	p.backend = b
+	p.mem = b.Memory()
+	p.verify = pc.verify
+	p.noReset = pc.noReset
+	p.haltPoll = pc.haltPoll
 	// Determine PRU version (AM18xx or AM33xx)
 	vers := p.rd(rREVID)
 	switch vers {
@@ -141,10 +159,19 @@ func Open(pc *Config) (*PRU, error) {
 		p.Order = binary.LittleEndian
 		p.version = am33xx
 	default:
-		f.Close()
 		return nil, fmt.Errorf("Unknown PRU version: 0x%08x", vers)
 	}
 	p.SharedRam = p.mem[am3xxSharedRam : am3xxSharedRam+am3xxSharedRamSize]
+	if rb, ok := b.(*rprocBackend); ok {
+		// The interrupt controller is owned by the kernel, so
+		// it is not configured.
+		if err := p.initRproc(pc, rb); err != nil {
+			return nil, err
+		}
+		p.initUnits(pc)
+		pru = p
+		return p, nil
+	}
 	// Validate config.
 	// All events must map to a host interrupt.
 	var cmr [nEvents / 4]uint32
@@ -160,8 +187,7 @@ func Open(pc *Config) (*PRU, error) {
 			p.sigMask[hostInt2Signal(int(hi))] |= 1 << se
 		}
 		p.evMask |= 1 << se
-		ev := new(Event)
-		ev.evChan = make(chan bool, 50)
+		ev := pc.newEvent(se)
 		ev.hostInt = uint32(hi)
 		p.events[se] = ev
 	}
@@ -177,26 +203,27 @@ func Open(pc *Config) (*PRU, error) {
 		hmr[c/4] |= uint32(hi) << ((c % 4) * 8)
 		hiMapped[c] = true
 	}
-	p.mmapFile = f
 	// Open signal devices for each enabled host interrupt (the first 2 are skipped).
+	d, err := newDispatcher(p.fail)
+	if err != nil {
+		return nil, err
+	}
 	for i := 0; i < nSignals; i++ {
 		if p.sigMask[i] != 0 {
-			f, err := os.OpenFile(fmt.Sprintf(drvUioBase, i), os.O_RDWR|os.O_SYNC, 0660)
+			f, err := b.Signal(i)
+			if err == nil {
+				_, err = d.add(f, 4, true, p.signalHandler(signal2HostInt(i), p.sigMask[i]), p.fail)
+			}
 			if err != nil {
-				p.Close()
+				d.close()
 				return nil, err
 			}
-			p.signals = append(p.signals, f)
-			go p.signalReader(signal2HostInt(i), p.sigMask[i], f)
 		}
 	}
+	p.disp = d
+	d.start()
 	// Start setting up hardware
-	if (pc.umask & 1) != 0 {
-		p.units[0] = newUnit(p, am3xxPru0Ram, am3xxPru0Iram, am3xxPru0Ctl)
-	}
-	if (pc.umask & 2) != 0 {
-		p.units[1] = newUnit(p, am3xxPru1Ram, am3xxPru1Iram, am3xxPru1Ctl)
-	}
+	p.initUnits(pc)
 	// Disable global interrupts
 	p.wr(rGER, 0)
 	// Clear any existing system events or interrupts.
@@ -223,6 +250,29 @@ func Open(pc *Config) (*PRU, error) {
 	return p, nil
 }
 
+// initUnits creates the units enabled in the config.
+func (p *PRU) initUnits(pc *Config) {
+	if (pc.umask & 1) != 0 {
+		p.units[0] = newUnit(p, 0, am3xxPru0Ram, am3xxPru0Iram, am3xxPru0Ctl, am3xxPru0Dbg)
+	}
+	if (pc.umask & 2) != 0 {
+		p.units[1] = newUnit(p, 1, am3xxPru1Ram, am3xxPru1Iram, am3xxPru1Ctl, am3xxPru1Dbg)
+	}
+	// Set the programmable constant table entries.
+	for i, u := range p.units {
+		if u == nil {
+			continue
+		}
+		for c, v := range pc.ctab[i] {
+			if c < 28 {
+				u.SetConstBlock(c, uint8(v))
+			} else {
+				u.SetConstPointer(c, v)
+			}
+		}
+	}
+}
+
 // Unit returns a structure pointer representing a single PRU Core
 func (p *PRU) Unit(u int) *Unit {
 	return p.units[u]
@@ -235,12 +285,20 @@ func (p *PRU) Event(id int) *Event {
 
 // SendEvent triggers a system event. Note that the system event
 // may not need to be part of the configuration.
+// If the PRU cores are managed by the RemoteProc driver, the interrupt controller
+// is owned by the kernel, and the system event is only raised, so the firmware
+// must have mapped the event for it to be received.
 func (p *PRU) SendEvent(se uint) {
 	p.wr64(rSRSR0, 1<<se)
 }
 
 // ClearEvent resets the system event, and re-enables the associated host interrupt.
+// This is not supported if the PRU cores are managed by the RemoteProc driver, since
+// the interrupt controller is owned by the kernel.
 func (p *PRU) ClearEvent(se uint) error {
+	if p.rproc != nil {
+		return fmt.Errorf("Event %d cannot be cleared with RemoteProc", se)
+	}
 	if p.events[se] == nil {
 		return fmt.Errorf("Event %d not configured", se)
 	}
@@ -253,60 +311,86 @@ func (p *PRU) ClearEvent(se uint) error {
 // Close deactivates the PRU subsystem, releasing all the resources associated with it.
 func (p *PRU) Close() {
 	for _, u := range p.units {
-		if u != nil {
+		if u != nil && !p.noReset {
 			u.Reset()
 		}
 	}
-	// Disable global interrupts
-	p.wr(rGER, 0)
-	p.wr64(rESR0, p.rd64(rESR0) &^ p.evMask)
-	p.wr64(rSECR0, p.evMask)
-	p.wr(rGER, 1)
-	pru = nil
-	for _, s := range p.signals {
-		s.Close()
+	if p.rproc == nil {
+		// Disable global interrupts
+		p.wr(rGER, 0)
+		p.wr64(rESR0, p.rd64(rESR0)&^p.evMask)
+		p.wr64(rSECR0, p.evMask)
+		p.wr(rGER, 1)
 	}
+	pru = nil
+	// Stop any events waiting for space in a full event queue before
+	// stopping the dispatcher.
 	for _, e := range p.events {
 		if e != nil {
-			e.ClearHandler()
-			close(e.evChan)
+			e.close()
 		}
 	}
-	unix.Munmap(p.mem)
-	p.mmapFile.Close()
+	p.disp.close()
+	p.backend.Close()
 }
 
-// signalReader polls the device, and signals events that are
-// associated with the device.
-func (p *PRU) signalReader(hi int, mask uint64, f *os.File) {
-	b := make([]byte, 4)
-	for {
-		n, err := f.Read(b)
-		if err != nil {
-			// Assume device has been closed.
+// signalHandler returns the handler for reads of a host interrupt device,
+// which signals the events that are associated with the device.
+func (p *PRU) signalHandler(hi int, mask uint64) func([]byte) {
+	return func(b []byte) {
+		if len(b) != 4 {
 			return
 		}
-		if n == 4 {
-			// Signal has been received on this host interrupt device
-			events := mask & p.rd64(rSRSR0) // Get active system events
-			p.wr64(rSECR0, events)          // Clear active system events
-			p.wr(rHIEISR, uint32(hi))       // Re-enable host interrupt
-			for {
-				// Find the next event in the mask.
-				fs := 63 - bits.LeadingZeros64(events)
-				if fs < 0 {
-					break
-				}
-				events &^= 1 << uint(fs)
-				select {
-				case p.events[fs].evChan <- true:
-					// Send event to channel
-				default:
-					// Unable to send, maybe the channel is closed.
-				}
+		// Signal has been received on this host interrupt device
+		now := time.Now()
+		events := mask & p.rd64(rSRSR0) // Get active system events
+		p.wr64(rSECR0, events)          // Clear active system events
+		p.wr(rHIEISR, uint32(hi))       // Re-enable host interrupt
+		for {
+			// Find the next event in the mask.
+			fs := 63 - bits.LeadingZeros64(events)
+			if fs < 0 {
+				break
 			}
+			events &^= 1 << uint(fs)
+			p.deliver(EventInfo{Event: fs, HostInt: hi, Time: now})
+		}
+	}
+}
+
+// deliver sends the event to the event's channel.
+func (p *PRU) deliver(info EventInfo) {
+	info.order = atomic.AddUint64(&p.order, 1)
+	p.events[info.Event].deliver(info)
+}
+
+// Err returns the first error that stopped the delivery of events,
+// such as a failure reading an event device, or nil if there has been no failure.
+func (p *PRU) Err() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.err
+}
+
+// fail records a failure reading the event devices.
+func (p *PRU) fail(err error) {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// Stats returns the delivery statistics of all the configured events,
+// indexed by system event.
+func (p *PRU) Stats() map[int]EventStats {
+	m := make(map[int]EventStats)
+	for se, e := range p.events {
+		if e != nil {
+			m[se] = e.Stats()
 		}
 	}
+	return m
 }
 
 // Description returns a human readable string describing the PRU
@@ -328,27 +412,27 @@ func (p *PRU) Description() string {
 
 // rd reads one 32 bit word from the shared memory area
 func (p *PRU) rd(offs uintptr) uint32 {
-	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&p.mem[offs])))
+	return p.backend.Load(offs)
 }
 
 // wr writes one 32 bit word to the shared memory area
 func (p *PRU) wr(offs uintptr, v uint32) {
-	atomic.StoreUint32((*uint32)(unsafe.Pointer(&p.mem[offs])), v)
+	p.backend.Store(offs, v)
 }
 
 // rd64 reads 2 32 bits words from successive addresses and combines them to a 64 bit value
 // The lower 32 bit of the 64 bit word is read from the first address
 func (p *PRU) rd64(offs uintptr) uint64 {
-	v := uint64(atomic.LoadUint32((*uint32)(unsafe.Pointer(&p.mem[offs]))))
-	v |= uint64(atomic.LoadUint32((*uint32)(unsafe.Pointer(&p.mem[offs+4])))) << 32
+	v := uint64(p.backend.Load(offs))
+	v |= uint64(p.backend.Load(offs+4)) << 32
 	return v
 }
 
 // rd64 writes a 64 bit value to 2 successive addresses
 // The lower 32 bits of the 64 bit word is written to the first address
 func (p *PRU) wr64(offs uintptr, v uint64) {
-	atomic.StoreUint32((*uint32)(unsafe.Pointer(&p.mem[offs])), uint32(v))
-	atomic.StoreUint32((*uint32)(unsafe.Pointer(&p.mem[offs+4])), uint32(v>>32))
+	p.backend.Store(offs, uint32(v))
+	p.backend.Store(offs+4, uint32(v>>32))
 }
 
 // write copies the 32 bit data to the shared memory area
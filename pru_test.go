@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/pru/asm"
+	"github.com/aamcrae/pru/sim"
+)
+
+// Timeout used when waiting for events or for a unit to halt.
+const testTimeout = 2 * time.Second
+
+// openSim opens the PRU on a simulator using the configuration.
+// The PRU is closed when the test completes.
+func openSim(t *testing.T, pc *Config) (*sim.Sim, *PRU) {
+	t.Helper()
+	s := sim.New()
+	p, err := OpenWithBackend(pc, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return s, p
+}
+
+// assemble assembles the program source.
+func assemble(t *testing.T, src string) []uint32 {
+	t.Helper()
+	prog, err := asm.Assemble("test.p", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prog.Code
+}
+
+// waitHalt waits for the unit to halt.
+func waitHalt(t *testing.T, u *Unit) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for u.IsRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("unit did not halt")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitReceived waits until the event has been received n times.
+func waitReceived(t *testing.T, e *Event, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for e.Stats().Received < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("event not received (stats %+v)", e.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestBackend checks that the PRU memory is accessed via the backend.
+func TestBackend(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	if desc := p.Description(); !strings.Contains(desc, "AM33xx") {
+		t.Errorf("description: got %q", desc)
+	}
+	u := p.Unit(1)
+	p.Order.PutUint32(u.Ram[8:], 0x12345678)
+	if v := s.Load(am3xxPru1Ram + 8); v != 0x12345678 {
+		t.Errorf("unit 1 RAM: got %#x, want %#x", v, 0x12345678)
+	}
+	s.Store(am3xxSharedRam+4, 0x87654321)
+	if v := p.Order.Uint32(p.SharedRam[4:]); v != 0x87654321 {
+		t.Errorf("shared RAM: got %#x, want %#x", v, uint32(0x87654321))
+	}
+	if err := u.LoadAt([]uint32{1, 2, 3}, 4); err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range []uint32{1, 2, 3} {
+		if v := s.Load(am3xxPru1Iram + uintptr(4+i*4)); v != w {
+			t.Errorf("IRAM word %d: got %#x, want %#x", i+1, v, w)
+		}
+	}
+	if _, err := OpenWithBackend(DefaultConfig, sim.New()); err == nil {
+		t.Errorf("second open: expected error")
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// RemoteProc paths.
+const (
+	rprocClass    = "/sys/class/remoteproc"
+	rprocFirmware = "/lib/firmware"
+	rpmsgDev      = "/dev/rpmsg_pru%d"
+	drvMem        = "/dev/mem"
+
+	am3xxMemSize = 0x80000 // Size of the PRU-ICSS address space
+
+	rpmsgTimeout = time.Second           // Time to wait for the rpmsg devices after starting firmware
+	rpmsgPoll    = 10 * time.Millisecond // Interval for checking for the rpmsg devices
+)
+
+// rprocBackend accesses the PRU-ICSS when the PRU cores are managed
+// by the RemoteProc driver. The PRU-ICSS memory is mapped via /dev/mem,
+// and the cores are stopped via RemoteProc so that they may be controlled
+// directly, or started via RemoteProc with firmware from /lib/firmware.
+// The interrupt controller is owned by the kernel, so events are
+// delivered via rpmsg devices rather than the host interrupts.
+type rprocBackend struct {
+	f     *os.File
+	root  string
+	mem   []byte
+	procs [nUnits]string // sysfs directory of the remoteproc for each unit
+	mu    sync.Mutex     // Protects the devices of the rpmsg channels
+	chans []*rpmsgChan
+}
+
+// rpmsgChan is an rpmsg device that delivers a system event.
+// The device only exists while the firmware that provides the channel
+// is running, so it is opened after the firmware is started, and
+// removed when the device is removed.
+type rpmsgChan struct {
+	se  int
+	ch  int
+	dev *device // Set while the device is open
+}
+
+// initRproc stops any enabled units that are running under RemoteProc control so
+// that they may be controlled directly (unless the units are to be left in their current state),
+// and then opens the rpmsg devices for the events in the config that are present.
+func (p *PRU) initRproc(pc *Config, b *rprocBackend) error {
+	for u := 0; u < nUnits && !pc.noReset; u++ {
+		if (pc.umask&(1<<uint(u))) != 0 && b.procs[u] != "" {
+			if err := b.stop(u); err != nil {
+				return err
+			}
+		}
+	}
+	d, err := newDispatcher(p.fail)
+	if err != nil {
+		return err
+	}
+	for se, ch := range pc.rpmsg {
+		b.chans = append(b.chans, &rpmsgChan{se: int(se), ch: ch})
+		p.events[se] = pc.newEvent(se)
+	}
+	p.disp = d
+	p.rproc = b
+	d.start()
+	if _, err := p.syncRpmsg(); err != nil {
+		d.close()
+		return err
+	}
+	return nil
+}
+
+// syncRpmsg removes any open rpmsg devices that no longer exist (e.g because the
+// firmware has been stopped), and opens the rpmsg devices that are present.
+// Returns true if all of the rpmsg devices are open.
+func (p *PRU) syncRpmsg() (bool, error) {
+	b := p.rproc
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all := true
+	for _, c := range b.chans {
+		name := b.rpmsgPath(c.ch)
+		if c.dev != nil {
+			if current(c.dev.f, name) {
+				continue
+			}
+			p.disp.remove(c.dev)
+			c.dev = nil
+		}
+		f, err := os.OpenFile(name, os.O_RDWR, 0660)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The firmware providing the channel is not running.
+				all = false
+				continue
+			}
+			return false, err
+		}
+		c.dev, err = p.disp.add(f, 512, false, p.messageHandler(c.se), b.rpmsgFailed(c, f))
+		if err != nil {
+			return false, err
+		}
+	}
+	return all, nil
+}
+
+// waitRpmsg waits for the rpmsg devices to be present after firmware has been started.
+// Devices that are not present after the timeout (such as those provided by the
+// firmware of the other unit) are opened when the rpmsg devices are next checked.
+func (p *PRU) waitRpmsg() error {
+	deadline := time.Now().Add(rpmsgTimeout)
+	for {
+		all, err := p.syncRpmsg()
+		if all || err != nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(rpmsgPoll)
+	}
+}
+
+// current returns true if the open file is the device currently at the path.
+func current(f *os.File, name string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	ni, err := os.Stat(name)
+	return err == nil && os.SameFile(fi, ni)
+}
+
+// rpmsgFailed returns the function invoked if reading the rpmsg device f fails.
+// The failure is not reported, since the device is removed when
+// the firmware is stopped; the device is re-opened when the firmware is restarted.
+func (b *rprocBackend) rpmsgFailed(c *rpmsgChan, f *os.File) func(error) {
+	return func(error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if c.dev != nil && c.dev.f == f {
+			c.dev = nil
+		}
+	}
+}
+
+// messageHandler returns the handler for messages read from the rpmsg device,
+// which signals the event associated with the device as each message is received.
+func (p *PRU) messageHandler(se int) func([]byte) {
+	return func([]byte) {
+		p.deliver(EventInfo{Event: se, HostInt: -1, Time: time.Now()})
+	}
+}
+
+// findRprocs scans the remoteproc devices under the root directory for the PRU cores,
+// returning the base address of the PRU-ICSS and the sysfs directory of each core.
+func findRprocs(root string) (int, [nUnits]string, bool) {
+	var procs [nUnits]string
+	var found bool
+	base := -1
+	dirs, _ := filepath.Glob(filepath.Join(root, rprocClass, "remoteproc*"))
+	for _, d := range dirs {
+		b, err := os.ReadFile(filepath.Join(d, "name"))
+		if err != nil {
+			continue
+		}
+		// PRU cores are named by the address of their IRAM e.g 4a334000.pru
+		var addr int
+		name := strings.TrimSpace(string(b))
+		if n, _ := fmt.Sscanf(name, "%x.pru", &addr); n != 1 || !strings.Contains(name, ".pru") {
+			continue
+		}
+		icss := addr &^ (am3xxMemSize - 1)
+		var u int
+		switch addr - icss {
+		case am3xxPru0Iram:
+			u = 0
+		case am3xxPru1Iram:
+			u = 1
+		default:
+			continue
+		}
+		if base >= 0 && base != icss {
+			// Only the first PRU-ICSS is used.
+			continue
+		}
+		base = icss
+		procs[u] = d
+		found = true
+	}
+	return base, procs, found
+}
+
+// newRprocBackend maps the PRU-ICSS memory for the PRU cores found.
+func newRprocBackend(root string, base int, procs [nUnits]string) (*rprocBackend, error) {
+	dev := filepath.Join(root, drvMem)
+	f, err := os.OpenFile(dev, os.O_RDWR|os.O_SYNC, 0660)
+	if err != nil {
+		return nil, err
+	}
+	mem, err := unix.Mmap(int(f.Fd()), int64(base), am3xxMemSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", dev, err)
+	}
+	return &rprocBackend{f: f, root: root, mem: mem, procs: procs}, nil
+}
+
+// Memory returns the mapped PRU-ICSS memory.
+func (b *rprocBackend) Memory() []byte {
+	return b.mem
+}
+
+// Load reads one 32 bit word from the mapped memory.
+func (b *rprocBackend) Load(offs uintptr) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&b.mem[offs])))
+}
+
+// Store writes one 32 bit word to the mapped memory.
+func (b *rprocBackend) Store(offs uintptr, v uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&b.mem[offs])), v)
+}
+
+// Signal is not supported, since the host interrupts are owned by the kernel.
+func (b *rprocBackend) Signal(sig int) (*os.File, error) {
+	return nil, fmt.Errorf("host interrupt %d not available with RemoteProc, use rpmsg", signal2HostInt(sig))
+}
+
+// rpmsgPath returns the path of the rpmsg device for the channel.
+func (b *rprocBackend) rpmsgPath(ch int) string {
+	return filepath.Join(b.root, fmt.Sprintf(rpmsgDev, ch))
+}
+
+// Close unmaps the memory.
+func (b *rprocBackend) Close() error {
+	unix.Munmap(b.mem)
+	return b.f.Close()
+}
+
+// state returns the RemoteProc state of the unit e.g "offline" or "running".
+func (b *rprocBackend) state(u int) (string, error) {
+	if b.procs[u] == "" {
+		return "", fmt.Errorf("unit %d: no remoteproc device", u)
+	}
+	s, err := os.ReadFile(filepath.Join(b.procs[u], "state"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(s)), nil
+}
+
+// setState writes the RemoteProc state of the unit i.e "start" or "stop".
+func (b *rprocBackend) setState(u int, s string) error {
+	if b.procs[u] == "" {
+		return fmt.Errorf("unit %d: no remoteproc device", u)
+	}
+	return os.WriteFile(filepath.Join(b.procs[u], "state"), []byte(s), 0644)
+}
+
+// stop stops the unit if it is running under RemoteProc control.
+func (b *rprocBackend) stop(u int) error {
+	s, err := b.state(u)
+	if err != nil {
+		return err
+	}
+	if s == "running" {
+		return b.setState(u, "stop")
+	}
+	return nil
+}
+
+// start copies the firmware to the firmware directory, and starts
+// the unit running the firmware under RemoteProc control.
+func (b *rprocBackend) start(u int, fw string) error {
+	if err := b.stop(u); err != nil {
+		return err
+	}
+	name := filepath.Base(fw)
+	dst := filepath.Join(b.root, rprocFirmware, name)
+	if dst != filepath.Clean(fw) {
+		if err := copyFile(fw, dst); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(b.procs[u], "firmware"), []byte(name), 0644); err != nil {
+		return err
+	}
+	return b.setState(u, "start")
+}
+
+// copyFile copies the src file to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Base address of the PRU-ICSS in the fake /dev/mem.
+const testIcssBase = 0x4a300000
+
+// rprocRoot creates a fake RemoteProc device tree, with unit 0 running
+// and unit 1 offline. /dev/mem is a sparse file containing the PRU-ICSS.
+func rprocRoot(t *testing.T) string {
+	t.Helper()
+	d := t.TempDir()
+	procs := map[string]string{
+		"remoteproc0": "wkup_m3",
+		"remoteproc1": "4a334000.pru",
+		"remoteproc2": "4a338000.pru",
+	}
+	for p, name := range procs {
+		dir := filepath.Join(d, rprocClass, p)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		state := "offline"
+		if p == "remoteproc1" {
+			state = "running"
+		}
+		writeFile(t, filepath.Join(dir, "name"), name+"\n")
+		writeFile(t, filepath.Join(dir, "state"), state+"\n")
+	}
+	for _, dir := range []string{"dev", rprocFirmware} {
+		if err := os.MkdirAll(filepath.Join(d, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Create(filepath.Join(d, drvMem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(testIcssBase + am3xxMemSize); err != nil {
+		t.Fatal(err)
+	}
+	var rev [4]byte
+	binary.LittleEndian.PutUint32(rev[:], 0x4E82A900)
+	if _, err := f.WriteAt(rev[:], testIcssBase+rREVID); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func writeFile(t *testing.T, name, s string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// makeRpmsg creates a FIFO as the rpmsg device for the channel, as if created by firmware.
+func makeRpmsg(t *testing.T, root string, ch int) string {
+	t.Helper()
+	name := (&rprocBackend{root: root}).rpmsgPath(ch)
+	if err := unix.Mkfifo(name, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// sendRpmsg writes a message to the rpmsg device. The write fails
+// if the device has not been opened by the PRU.
+func sendRpmsg(t *testing.T, name string) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_WRONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRprocOpen(t *testing.T) {
+	root := rprocRoot(t)
+	p, err := Open(NewConfig().Root(root).EnableUnit(0).Rpmsg(18, 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if s := readFile(t, filepath.Join(root, rprocClass, "remoteproc1/state")); s != "stop" {
+		t.Errorf("unit 0 state: got %q, want stop", s)
+	}
+	if s := readFile(t, filepath.Join(root, rprocClass, "remoteproc2/state")); s != "offline" {
+		t.Errorf("unit 1 state: got %q, want offline", s)
+	}
+	if p.Event(18) == nil {
+		t.Fatalf("rpmsg event not configured")
+	}
+	if err := p.ClearEvent(18); err == nil {
+		t.Errorf("ClearEvent: expected error")
+	}
+}
+
+func TestRprocFirmware(t *testing.T) {
+	root := rprocRoot(t)
+	p, err := Open(NewConfig().Root(root).EnableUnit(0).Rpmsg(18, 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	fw := filepath.Join(t.TempDir(), "test-fw")
+	writeFile(t, fw, "firmware")
+	proc := filepath.Join(root, rprocClass, "remoteproc1")
+	for i := 0; i < 2; i++ {
+		// The device is created when the firmware starts.
+		dev := makeRpmsg(t, root, 30)
+		if err := p.Unit(0).LoadFirmware(fw); err != nil {
+			t.Fatal(err)
+		}
+		if s := readFile(t, filepath.Join(root, rprocFirmware, "test-fw")); s != "firmware" {
+			t.Errorf("firmware not copied: %q", s)
+		}
+		if s := readFile(t, filepath.Join(proc, "firmware")); s != "test-fw" {
+			t.Errorf("firmware name: got %q", s)
+		}
+		if s := readFile(t, filepath.Join(proc, "state")); s != "start" {
+			t.Errorf("state: got %q, want start", s)
+		}
+		sendRpmsg(t, dev)
+		select {
+		case info := <-p.Event(18).Chan():
+			if info.HostInt != -1 {
+				t.Errorf("rpmsg event host interrupt: got %d", info.HostInt)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("run %d: rpmsg event not received", i)
+		}
+		// Stopping the firmware removes the device.
+		writeFile(t, filepath.Join(proc, "state"), "running")
+		os.Remove(dev)
+		p.Unit(0).Reset()
+		if s := readFile(t, filepath.Join(proc, "state")); s != "stop" {
+			t.Errorf("state: got %q, want stop", s)
+		}
+	}
+	if err := p.Err(); err != nil {
+		t.Errorf("Err: %v", err)
+	}
+}
+
+func TestRprocNoReset(t *testing.T) {
+	root := rprocRoot(t)
+	dev := makeRpmsg(t, root, 31)
+	p, err := Open(NewConfig().Root(root).EnableUnit(0).Rpmsg(20, 31).NoReset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if s := readFile(t, filepath.Join(root, rprocClass, "remoteproc1/state")); s != "running" {
+		t.Errorf("unit 0 state: got %q, want running", s)
+	}
+	// The device is present, so it is opened when the PRU is opened.
+	sendRpmsg(t, dev)
+	if ok, err := p.Event(20).WaitTimeout(testTimeout); err != nil || !ok {
+		t.Errorf("rpmsg event not received (%v)", err)
+	}
+}
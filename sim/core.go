@@ -0,0 +1,672 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+)
+
+const (
+	nUnits = 2 // Number of PRU cores
+
+	// Memory offsets
+	pru0Ram   = 0x00000000
+	pru1Ram   = 0x00002000
+	pru0Ctl   = 0x00022000
+	pru0Dbg   = 0x00022400
+	pru1Ctl   = 0x00024000
+	pru1Dbg   = 0x00024400
+	pru0Iram  = 0x00034000
+	pru1Iram  = 0x00038000
+	ramSize   = 8 * 1024
+	iramSize  = 8 * 1024
+	ctlSize   = 0x100
+	dbgSize   = 0x100
+	icssAddr  = 0x4A300000 // Global address of the PRU-ICSS
+	regsSize  = 32 * 4     // Size of the register file
+	ctRegOffs = 0x80       // Offset of constant table in debug window
+
+	// Control registers offset
+	c_CONTROL   = 0x00
+	c_STATUS    = 0x04
+	c_WAKEUP_EN = 0x08
+	c_CYCLE     = 0x0C
+	c_STALL     = 0x10
+	c_CTBIR0    = 0x20
+	c_CTBIR1    = 0x24
+	c_CTPPR0    = 0x28
+	c_CTPPR1    = 0x2C
+
+	ctl_RESET       = 0x0001
+	ctl_ENABLE      = 0x0002
+	ctl_SLEEPING    = 0x0004
+	ctl_COUNTER_EN  = 0x0008
+	ctl_SINGLE_STEP = 0x0100
+	ctl_RUNSTATE    = 0x8000
+
+	yieldCount = 1024 // Instructions executed before yielding the processor
+)
+
+// Fixed entries of the constant table.
+var constTable = [32]uint32{
+	0x00020000, 0x48040000, 0x4802A000, 0x00030000,
+	0x00026000, 0x48060000, 0x48030000, 0x00028000,
+	0x46000000, 0x4A100000, 0x48318000, 0x48022000,
+	0x48024000, 0x48310000, 0x481CC000, 0x481D0000,
+	0x481A0000, 0x4819C000, 0x48300000, 0x48302000,
+	0x48304000, 0x00032400, 0x480C8000, 0x480CA000,
+}
+
+// core models a single PRU core.
+type core struct {
+	s      *Sim
+	ram    uintptr // Local data RAM
+	other  uintptr // Data RAM of the other core
+	ctl    uintptr // Control registers
+	dbg    uintptr // Debug registers
+	iram   uintptr // Instruction RAM
+	pc     uint32  // Program counter (word address)
+	carry  bool
+	inputs uint32 // R31 GPI bits
+	err    error
+	wake   chan struct{}
+	pcSet  bool // PC has been set by the instruction
+}
+
+// newCore creates the model of a PRU core.
+func newCore(s *Sim, ram, other, ctl, dbg, iram uintptr) *core {
+	c := &core{s: s, ram: ram, other: other, ctl: ctl, dbg: dbg, iram: iram}
+	c.wake = make(chan struct{}, 1)
+	s.store(ctl+c_CONTROL, ctl_RESET)
+	c.updateConstTable()
+	return c
+}
+
+// SetInputs sets the general purpose input bits (0 - 29) of R31 on the unit.
+func (s *Sim) SetInputs(unit int, v uint32) {
+	s.mu.Lock()
+	s.cores[unit%nUnits].inputs = v & 0x3FFFFFFF
+	s.mu.Unlock()
+	s.wakeCores()
+}
+
+// Outputs returns the general purpose output bits (R30) of the unit.
+func (s *Sim) Outputs(unit int) uint32 {
+	c := s.cores[unit%nUnits]
+	return s.Load(c.dbg + 30*4)
+}
+
+// Error returns the error that caused the unit to halt, or nil if
+// the unit has not halted due to an error.
+func (s *Sim) Error(unit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cores[unit%nUnits].err
+}
+
+// wakeCores notifies the cores that their state may have changed.
+func (s *Sim) wakeCores() {
+	for _, c := range s.cores {
+		if c != nil {
+			c.notify()
+		}
+	}
+}
+
+// notify wakes the core's goroutine.
+func (c *core) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// storeCtl handles a write to the core's control registers.
+// The lock must be held.
+func (c *core) storeCtl(offs uintptr, v uint32) {
+	ctl := c.s.Load(c.ctl + c_CONTROL)
+	switch offs {
+	case c_CONTROL:
+		if (v & ctl_RESET) == 0 {
+			// Soft reset, which loads the PC from the reset value.
+			c.pc = v >> 16
+			c.carry = false
+			c.err = nil
+			c.s.store(c.ctl+c_STATUS, c.pc)
+			v |= ctl_RESET
+		}
+		if (ctl&ctl_SLEEPING) != 0 && (v&ctl_SLEEPING) != 0 {
+			v |= ctl_SLEEPING
+		} else {
+			// The host may clear the sleeping status to wake the core,
+			// but cannot set it.
+			v &^= ctl_SLEEPING
+		}
+		if (v & ctl_ENABLE) != 0 {
+			v |= ctl_RUNSTATE
+		} else {
+			v &^= ctl_RUNSTATE
+		}
+		c.s.store(c.ctl+c_CONTROL, v)
+		c.notify()
+	case c_STATUS:
+		// Read only.
+	case c_CYCLE, c_STALL:
+		// Counters may only be written when disabled.
+		if (ctl & ctl_COUNTER_EN) == 0 {
+			c.s.store(c.ctl+offs, v)
+		}
+	case c_CTBIR0, c_CTBIR1, c_CTPPR0, c_CTPPR1:
+		c.s.store(c.ctl+offs, v)
+		c.updateConstTable()
+	default:
+		c.s.store(c.ctl+offs, v)
+		c.notify()
+	}
+}
+
+// updateConstTable calculates the programmable constant table
+// entries and stores the table in the debug registers.
+// The lock must be held.
+func (c *core) updateConstTable() {
+	ctbir0 := c.s.Load(c.ctl + c_CTBIR0)
+	ctbir1 := c.s.Load(c.ctl + c_CTBIR1)
+	ctppr0 := c.s.Load(c.ctl + c_CTPPR0)
+	ctppr1 := c.s.Load(c.ctl + c_CTPPR1)
+	ct := constTable
+	ct[24] = 0x00000000 | (ctbir0&0xFF)<<8
+	ct[25] = 0x00002000 | ((ctbir0>>16)&0xFF)<<8
+	ct[26] = 0x0002E000 | (ctbir1&0xFF)<<8
+	ct[27] = 0x00032000 | ((ctbir1>>16)&0xFF)<<8
+	ct[28] = 0x00000000 | (ctppr0&0xFFFF)<<8
+	ct[29] = 0x49000000 | (ctppr0>>16)<<8
+	ct[30] = 0x40000000 | (ctppr1&0xFFFF)<<8
+	ct[31] = 0x80000000 | (ctppr1>>16)<<8
+	for i, v := range ct {
+		c.s.store(c.dbg+ctRegOffs+uintptr(i*4), v)
+	}
+}
+
+// run is the goroutine that executes instructions while the core is enabled.
+func (c *core) run() {
+	for {
+		select {
+		case <-c.s.done:
+			return
+		case <-c.wake:
+		}
+		for n := 1; ; n++ {
+			c.s.mu.Lock()
+			ok := c.step()
+			c.s.mu.Unlock()
+			if !ok {
+				break
+			}
+			if n%yieldCount == 0 {
+				select {
+				case <-c.s.done:
+					return
+				default:
+				}
+				runtime.Gosched()
+			}
+		}
+	}
+}
+
+// step executes one instruction, returning false if the core
+// is disabled or sleeping.
+// The lock must be held.
+func (c *core) step() bool {
+	ctl := c.s.Load(c.ctl + c_CONTROL)
+	if (ctl & ctl_ENABLE) == 0 {
+		return false
+	}
+	if (ctl & ctl_SLEEPING) != 0 {
+		if (c.r31() & c.s.Load(c.ctl+c_WAKEUP_EN)) == 0 {
+			return false
+		}
+		ctl &^= ctl_SLEEPING
+		c.s.store(c.ctl+c_CONTROL, ctl)
+	}
+	if c.pc >= iramSize/4 {
+		c.fault(fmt.Errorf("PC 0x%04x outside IRAM", c.pc))
+		return false
+	}
+	ins := c.s.Load(c.iram + uintptr(c.pc*4))
+	c.pcSet = false
+	// The cycle counter is updated as each cycle occurs, so the issue
+	// cycle is counted before the instruction is executed.
+	c.count(1, 0)
+	if err := c.exec(ins); err != nil {
+		c.fault(fmt.Errorf("0x%04x: %08x: %v", c.pc, ins, err))
+		return false
+	}
+	if !c.pcSet {
+		c.pc = (c.pc + 1) & 0xFFFF
+	}
+	c.s.store(c.ctl+c_STATUS, c.pc)
+	ctl = c.s.Load(c.ctl + c_CONTROL)
+	if (ctl & ctl_SINGLE_STEP) != 0 {
+		c.s.store(c.ctl+c_CONTROL, ctl&^(ctl_ENABLE|ctl_RUNSTATE))
+		return false
+	}
+	return (ctl & ctl_ENABLE) != 0
+}
+
+// fault halts the core because of an execution error.
+func (c *core) fault(err error) {
+	c.err = err
+	c.halt()
+}
+
+// halt disables the core, leaving the PC at the current instruction.
+func (c *core) halt() {
+	ctl := c.s.Load(c.ctl + c_CONTROL)
+	c.s.store(c.ctl+c_CONTROL, ctl&^(ctl_ENABLE|ctl_RUNSTATE))
+	c.s.store(c.ctl+c_STATUS, c.pc)
+	c.pcSet = true
+}
+
+// count updates the cycle and stall counters if they are enabled.
+func (c *core) count(cycles, stalls int) {
+	if (c.s.Load(c.ctl+c_CONTROL) & ctl_COUNTER_EN) != 0 {
+		c.s.store(c.ctl+c_CYCLE, c.s.Load(c.ctl+c_CYCLE)+uint32(cycles))
+		c.s.store(c.ctl+c_STALL, c.s.Load(c.ctl+c_STALL)+uint32(stalls))
+	}
+}
+
+// exec decodes and executes a single instruction.
+func (c *core) exec(ins uint32) error {
+	switch ins >> 29 {
+	case 0:
+		return c.alu(ins)
+	case 1:
+		return c.format2(ins)
+	case 2, 3:
+		c.quickBranch(ins)
+	case 4:
+		// LBCO/SBCO
+		return c.memory(ins, c.constant(int(ins>>8)&0x1F))
+	case 6:
+		c.bitBranch(ins)
+	case 7:
+		// LBBO/SBBO
+		return c.memory(ins, c.reg(int(ins>>8)&0x1F|0xE0))
+	default:
+		return fmt.Errorf("illegal instruction")
+	}
+	return nil
+}
+
+// alu executes the format 1 arithmetic and logical instructions.
+func (c *core) alu(ins uint32) error {
+	rd := int(ins) & 0xFF
+	a := c.reg(int(ins>>8) & 0xFF)
+	b := c.op2(ins)
+	mask := fieldMask(rd)
+	var r uint64
+	carry := c.carry
+	switch (ins >> 25) & 0xF {
+	case 0: // ADD
+		r = uint64(a) + uint64(b)
+		carry = r > mask
+	case 1: // ADC
+		r = uint64(a) + uint64(b) + bool2u64(c.carry)
+		carry = r > mask
+	case 2: // SUB
+		r = uint64(a) - uint64(b)
+		carry = b > a
+	case 3: // SUC
+		r = uint64(a) - uint64(b) - bool2u64(c.carry)
+		carry = uint64(b)+bool2u64(c.carry) > uint64(a)
+	case 4: // LSL
+		r = uint64(a) << (b & 0x1F)
+	case 5: // LSR
+		r = uint64(a) >> (b & 0x1F)
+	case 6: // RSB
+		r = uint64(b) - uint64(a)
+		carry = a > b
+	case 7: // RSC
+		r = uint64(b) - uint64(a) - bool2u64(c.carry)
+		carry = uint64(a)+bool2u64(c.carry) > uint64(b)
+	case 8: // AND
+		r = uint64(a & b)
+	case 9: // OR
+		r = uint64(a | b)
+	case 10: // XOR
+		r = uint64(a ^ b)
+	case 11: // NOT
+		r = uint64(^a)
+	case 12: // MIN
+		r = uint64(a)
+		if b < a {
+			r = uint64(b)
+		}
+	case 13: // MAX
+		r = uint64(a)
+		if b > a {
+			r = uint64(b)
+		}
+	case 14: // CLR
+		r = uint64(a &^ (1 << (b & 0x1F)))
+	case 15: // SET
+		r = uint64(a | (1 << (b & 0x1F)))
+	}
+	c.carry = carry
+	c.setReg(rd, uint32(r&mask))
+	return nil
+}
+
+// format2 executes the jump, load immediate, left most bit detect,
+// halt and sleep instructions.
+func (c *core) format2(ins uint32) error {
+	switch (ins >> 25) & 0xF {
+	case 0, 1: // JMP, JAL
+		var target uint32
+		if (ins & (1 << 24)) != 0 {
+			target = (ins >> 8) & 0xFFFF
+		} else {
+			target = c.reg(int(ins>>16)&0xFF) & 0xFFFF
+		}
+		if ((ins >> 25) & 0xF) == 1 {
+			c.setReg(int(ins)&0xFF, c.pc+1)
+		}
+		c.jump(target)
+	case 2: // LDI
+		c.setReg(int(ins)&0xFF, (ins>>8)&0xFFFF)
+	case 3: // LMBD
+		rd := int(ins) & 0xFF
+		rs := int(ins>>8) & 0xFF
+		v := c.reg(rs)
+		bit := c.op2(ins) & 1
+		r := uint32(32)
+		for i := fieldWidth(rs) - 1; i >= 0; i-- {
+			if (v>>uint(i))&1 == bit {
+				r = uint32(i)
+				break
+			}
+		}
+		c.setReg(rd, r)
+	case 5: // HALT
+		c.halt()
+	case 7: // XIN, XOUT, XCHG
+		return c.xfr(ins)
+	case 15: // SLP
+		ctl := c.s.Load(c.ctl + c_CONTROL)
+		c.s.store(c.ctl+c_CONTROL, ctl|ctl_SLEEPING)
+	default:
+		return fmt.Errorf("unsupported instruction")
+	}
+	return nil
+}
+
+// xfr executes the register transfer instructions. Only the ZERO and FILL pseudo
+// instructions (XIN from the device IDs 255 and 254) are supported, since the
+// broadside devices (e.g the scratch pad) are not simulated.
+func (c *core) xfr(ins uint32) error {
+	var v byte
+	switch {
+	case (ins>>23)&3 == 1 && (ins>>15)&0xFF == 0xFF: // ZERO
+	case (ins>>23)&3 == 1 && (ins>>15)&0xFF == 0xFE: // FILL
+		v = 0xFF
+	default:
+		return fmt.Errorf("unsupported instruction")
+	}
+	l := int(ins>>7)&0x7F + 1
+	rb := int(ins&0x1F)*4 + int(ins>>5)&3
+	if rb+l > regsSize {
+		return fmt.Errorf("burst beyond register file")
+	}
+	regs := c.regBytes()
+	for i := rb; i < rb+l; i++ {
+		regs[i] = v
+	}
+	c.setRegBytes(regs)
+	return nil
+}
+
+// quickBranch executes the QBGT, QBGE, QBLT, QBLE, QBEQ, QBNE and QBA instructions.
+// The branch is taken if the comparison of the second operand with the
+// first operand is true.
+func (c *core) quickBranch(ins uint32) {
+	cond := (ins >> 27) & 7
+	a := c.reg(int(ins>>8) & 0xFF)
+	b := c.op2(ins)
+	if (cond&1 != 0 && b > a) || (cond&2 != 0 && b == a) || (cond&4 != 0 && b < a) {
+		c.branch(ins)
+	}
+}
+
+// bitBranch executes the QBBC and QBBS instructions.
+func (c *core) bitBranch(ins uint32) {
+	a := c.reg(int(ins>>8) & 0xFF)
+	bit := (a >> (c.op2(ins) & 0x1F)) & 1
+	switch (ins >> 27) & 3 {
+	case 1: // QBBC
+		if bit == 0 {
+			c.branch(ins)
+		}
+	case 2: // QBBS
+		if bit != 0 {
+			c.branch(ins)
+		}
+	}
+}
+
+// branch moves the PC by the signed 10 bit word offset of a quick branch.
+func (c *core) branch(ins uint32) {
+	offs := ((ins>>17)&0x300 | ins&0xFF) << 22
+	c.jump(c.pc + uint32(int32(offs)>>22))
+}
+
+// jump sets the PC to the target.
+func (c *core) jump(target uint32) {
+	c.pc = target & 0xFFFF
+	c.pcSet = true
+}
+
+// memory executes the LBBO, SBBO, LBCO and SBCO instructions.
+// Loads stall for one cycle for each 32 bit word read.
+func (c *core) memory(ins, base uint32) error {
+	l := int((ins>>21)&0x70 | (ins>>12)&0xE | (ins>>7)&1)
+	if l >= 124 {
+		l = int(c.regBytes()[l-124])
+	} else {
+		l++
+	}
+	var offs uint32
+	if (ins & (1 << 24)) != 0 {
+		offs = (ins >> 16) & 0xFF
+	} else {
+		offs = c.reg(int(ins>>16) & 0xFF)
+	}
+	addr := base + offs
+	rb := int(ins&0x1F)*4 + int(ins>>5)&3
+	if rb+l > regsSize {
+		return fmt.Errorf("burst beyond register file")
+	}
+	if (ins & (1 << 28)) == 0 {
+		return c.write(addr, c.regBytes()[rb:rb+l])
+	}
+	// The burst is read after the stall cycle of the first word.
+	c.count(1, 1)
+	b := make([]byte, l)
+	if err := c.read(addr, b); err != nil {
+		return err
+	}
+	if words := (l + 3) / 4; words > 1 {
+		c.count(words-1, words-1)
+	}
+	regs := c.regBytes()
+	copy(regs[rb:], b)
+	c.setRegBytes(regs)
+	return nil
+}
+
+// translate converts the address on the core to an offset
+// in the PRU-ICSS memory.
+func (c *core) translate(addr uint32) (uintptr, error) {
+	switch {
+	case addr < ramSize:
+		return c.ram + uintptr(addr), nil
+	case addr < 2*ramSize:
+		return c.other + uintptr(addr-ramSize), nil
+	case addr < memSize:
+		return uintptr(addr), nil
+	case addr >= icssAddr && addr < icssAddr+memSize:
+		return uintptr(addr - icssAddr), nil
+	}
+	return 0, fmt.Errorf("address 0x%08x not accessible", addr)
+}
+
+// read copies memory into the byte slice, using 32 bit accesses.
+func (c *core) read(addr uint32, b []byte) error {
+	var w [4]byte
+	for i := 0; i < len(b); {
+		offs, err := c.translate(addr &^ 3)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(w[:], c.s.Load(offs))
+		n := copy(b[i:], w[addr&3:])
+		i += n
+		addr += uint32(n)
+	}
+	return nil
+}
+
+// write copies the byte slice to memory, using 32 bit accesses so that
+// writes to registers have the appropriate side effects.
+func (c *core) write(addr uint32, b []byte) error {
+	var w [4]byte
+	for i := 0; i < len(b); {
+		offs, err := c.translate(addr &^ 3)
+		if err != nil {
+			return err
+		}
+		if (addr&3) != 0 || len(b)-i < 4 {
+			binary.LittleEndian.PutUint32(w[:], c.s.Load(offs))
+		}
+		n := copy(w[addr&3:], b[i:])
+		c.s.storeLocked(offs, binary.LittleEndian.Uint32(w[:]))
+		i += n
+		addr += uint32(n)
+	}
+	return nil
+}
+
+// constant returns the constant table entry.
+func (c *core) constant(n int) uint32 {
+	return c.s.Load(c.dbg + ctRegOffs + uintptr(n*4))
+}
+
+// op2 returns the second operand, which is either an 8 bit immediate
+// value or a register field.
+func (c *core) op2(ins uint32) uint32 {
+	if (ins & (1 << 24)) != 0 {
+		return (ins >> 16) & 0xFF
+	}
+	return c.reg(int(ins>>16) & 0xFF)
+}
+
+// r31 returns the value of the R31 input register, which contains the
+// general purpose inputs and the host interrupt 0 and 1 status.
+func (c *core) r31() uint32 {
+	return c.inputs | c.s.intc.pruInts<<30
+}
+
+// reg reads the register field, which is a register number (bits 0-4)
+// and a field selector (bits 5-7).
+func (c *core) reg(f int) uint32 {
+	var v uint32
+	if f&0x1F == 31 {
+		v = c.r31()
+	} else {
+		v = c.s.Load(c.dbg + uintptr(f&0x1F)*4)
+	}
+	return (v >> fieldShift(f)) & uint32(fieldMask(f))
+}
+
+// setReg writes the value to the register field.
+// Writing R31 with bit 5 set generates the system event 16 + bits 0-3.
+func (c *core) setReg(f int, v uint32) {
+	v = (v & uint32(fieldMask(f))) << fieldShift(f)
+	if f&0x1F == 31 {
+		if (v & 0x20) != 0 {
+			c.s.intc.raw |= 1 << (16 + v&0xF)
+			c.s.updateIntc()
+		}
+		return
+	}
+	offs := c.dbg + uintptr(f&0x1F)*4
+	m := uint32(fieldMask(f)) << fieldShift(f)
+	c.s.store(offs, c.s.Load(offs)&^m|v)
+}
+
+// regBytes returns a copy of the register file as a little endian byte array.
+func (c *core) regBytes() []byte {
+	b := make([]byte, regsSize)
+	for i := 0; i < 31; i++ {
+		binary.LittleEndian.PutUint32(b[i*4:], c.s.Load(c.dbg+uintptr(i*4)))
+	}
+	binary.LittleEndian.PutUint32(b[31*4:], c.r31())
+	return b
+}
+
+// setRegBytes writes the register file from a little endian byte array.
+func (c *core) setRegBytes(b []byte) {
+	for i := 0; i < 31; i++ {
+		c.s.store(c.dbg+uintptr(i*4), binary.LittleEndian.Uint32(b[i*4:]))
+	}
+}
+
+// fieldShift returns the bit offset of the register field.
+func fieldShift(f int) uint {
+	sel := f >> 5
+	switch {
+	case sel < 4:
+		return uint(sel) * 8
+	case sel < 7:
+		return uint(sel-4) * 8
+	}
+	return 0
+}
+
+// fieldWidth returns the number of bits in the register field.
+func fieldWidth(f int) int {
+	sel := f >> 5
+	switch {
+	case sel < 4:
+		return 8
+	case sel < 7:
+		return 16
+	}
+	return 32
+}
+
+// fieldMask returns the mask of the register field.
+func fieldMask(f int) uint64 {
+	return 1<<uint(fieldWidth(f)) - 1
+}
+
+func bool2u64(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"fmt"
+)
+
+const (
+	nEvents   = 64 // Number of system events
+	nChannels = 10 // Number of interrupt channels
+	nHostInts = 10 // Number of host interrupts
+
+	// Interrupt controller address range
+	intcBase = 0x20000
+	intcEnd  = 0x22000
+
+	// Interrupt controller register offsets
+	rGER     = 0x20010
+	rGPIR    = 0x20080
+	rSISR    = 0x20020
+	rSICR    = 0x20024
+	rEISR    = 0x20028
+	rEICR    = 0x2002C
+	rHIEISR  = 0x20034
+	rHIDISR  = 0x20038
+	rSRSR0   = 0x20200
+	rSRSR1   = 0x20204
+	rSECR0   = 0x20280
+	rSECR1   = 0x20284
+	rESR0    = 0x20300
+	rESR1    = 0x20304
+	rECR0    = 0x20380
+	rECR1    = 0x20384
+	rCMRBase = 0x20400
+	rHMRBase = 0x20800
+	rHIPIR   = 0x20900
+	rHIER    = 0x21500
+
+	noPending = 0x80000000 // Prioritized index value when no event is pending
+)
+
+// intc holds the state of the interrupt controller.
+type intc struct {
+	raw     uint64 // Raw system event status
+	enabled uint64 // Enabled system events
+	hostEn  uint32 // Enabled host interrupts
+	global  bool   // Global enable
+	pruInts uint32 // Status of host interrupts 0 and 1, routed to the PRU cores
+}
+
+// RaiseEvent sets the status of a system event, as if it were
+// triggered by the hardware or a PRU core.
+func (s *Sim) RaiseEvent(se int) error {
+	if se < 0 || se >= nEvents {
+		return fmt.Errorf("system event %d out of range", se)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.intc.raw |= 1 << uint(se)
+	s.updateIntc()
+	return nil
+}
+
+// HostInterrupt returns true if the host interrupt is asserted i.e
+// an enabled system event mapped to the host interrupt is pending.
+func (s *Sim) HostInterrupt(hi int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hostPending(hi) != 0
+}
+
+// storeIntc handles a write to an interrupt controller register.
+// The lock must be held.
+func (s *Sim) storeIntc(offs uintptr, v uint32) {
+	ic := &s.intc
+	switch offs {
+	case rGER:
+		ic.global = (v & 1) != 0
+		s.store(offs, v&1)
+	case rSISR:
+		ic.raw |= 1 << (v % nEvents)
+	case rSICR:
+		ic.raw &^= 1 << (v % nEvents)
+	case rEISR:
+		ic.enabled |= 1 << (v % nEvents)
+	case rEICR:
+		ic.enabled &^= 1 << (v % nEvents)
+	case rHIEISR:
+		ic.hostEn |= 1 << (v % nHostInts)
+	case rHIDISR:
+		ic.hostEn &^= 1 << (v % nHostInts)
+	case rSRSR0:
+		ic.raw |= uint64(v)
+	case rSRSR1:
+		ic.raw |= uint64(v) << 32
+	case rSECR0:
+		ic.raw &^= uint64(v)
+	case rSECR1:
+		ic.raw &^= uint64(v) << 32
+	case rESR0:
+		ic.enabled |= uint64(v)
+	case rESR1:
+		ic.enabled |= uint64(v) << 32
+	case rECR0:
+		ic.enabled &^= uint64(v)
+	case rECR1:
+		ic.enabled &^= uint64(v) << 32
+	case rHIER:
+		ic.hostEn = v & (1<<nHostInts - 1)
+	default:
+		// Channel and host map registers, polarity, type etc.
+		// are stored without any side effects.
+		s.store(offs, v)
+	}
+	s.updateIntc()
+}
+
+// channel returns the channel that the system event is mapped to.
+func (s *Sim) channel(se int) int {
+	cmr := s.Load(rCMRBase + uintptr(se&^3))
+	return int(cmr>>(uint(se%4)*8)) & 0xF
+}
+
+// hostInt returns the host interrupt that the channel is mapped to.
+func (s *Sim) hostInt(c int) int {
+	hmr := s.Load(rHMRBase + uintptr(c&^3))
+	return int(hmr>>(uint(c%4)*8)) & 0xF
+}
+
+// hostPending returns the set of enabled and pending system
+// events that are mapped to the host interrupt.
+// The lock must be held.
+func (s *Sim) hostPending(hi int) uint64 {
+	var ev uint64
+	pending := s.intc.raw & s.intc.enabled
+	for se := 0; se < nEvents; se++ {
+		if (pending&(1<<uint(se))) != 0 && s.hostInt(s.channel(se)) == hi {
+			ev |= 1 << uint(se)
+		}
+	}
+	return ev
+}
+
+// prioritized returns the highest priority event of the set, which
+// is the lowest numbered event on the lowest numbered channel.
+func (s *Sim) prioritized(ev uint64) uint32 {
+	best, bestChan := uint32(noPending), nChannels
+	for se := 0; se < nEvents; se++ {
+		if (ev & (1 << uint(se))) != 0 {
+			if c := s.channel(se); c < bestChan {
+				best, bestChan = uint32(se), c
+			}
+		}
+	}
+	return best
+}
+
+// updateIntc refreshes the status registers and raises any host
+// interrupts that are enabled and have pending events.
+// Host interrupts 0 and 1 are routed to the PRU cores and are read
+// through R31; the remaining host interrupts are routed to the
+// event devices. Like the UIO driver, raising an interrupt on an event device
+// disables the host interrupt until it is re-enabled via HIEISR.
+// The lock must be held.
+func (s *Sim) updateIntc() {
+	ic := &s.intc
+	s.store(rSRSR0, uint32(ic.raw))
+	s.store(rSRSR1, uint32(ic.raw>>32))
+	s.store(rSECR0, uint32(ic.raw&ic.enabled))
+	s.store(rSECR1, uint32((ic.raw&ic.enabled)>>32))
+	s.store(rESR0, uint32(ic.enabled))
+	s.store(rESR1, uint32(ic.enabled>>32))
+	s.store(rECR0, uint32(ic.enabled))
+	s.store(rECR1, uint32(ic.enabled>>32))
+	s.store(rHIER, ic.hostEn)
+	var all uint64
+	pruInts := ic.pruInts
+	ic.pruInts = 0
+	for hi := 0; hi < nHostInts; hi++ {
+		ev := s.hostPending(hi)
+		all |= ev
+		s.store(rHIPIR+uintptr(hi*4), s.prioritized(ev))
+		if ev == 0 || !ic.global || (ic.hostEn&(1<<uint(hi))) == 0 {
+			continue
+		}
+		if hi < 2 {
+			ic.pruInts |= 1 << uint(hi)
+			continue
+		}
+		ic.hostEn &^= 1 << uint(hi)
+		s.store(rHIER, ic.hostEn)
+		s.interrupt(hi - 2)
+	}
+	s.store(rGPIR, s.prioritized(all))
+	if pruInts != ic.pruInts {
+		s.wakeCores()
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package sim provides an in-process model of the PRU-ICSS subsystem that
+can be used as a backend for the pru package, so that programs using the
+package can be run without PRU hardware e.g
+
+	s := sim.New()
+	p, err := pru.OpenWithBackend(pru.DefaultConfig, s)
+
+The memory of the subsystem is modelled as a simple register file.
+The interrupt controller is modelled so that system events are mapped
+via the channel map and host interrupt map registers to host interrupts,
+which are delivered through the simulated event devices. System events
+may be raised directly using RaiseEvent, allowing event handling to be
+tested deterministically.
+
+Each PRU core is modelled by an instruction set simulator that executes
+the program loaded into the core's instruction RAM whenever the core
+is enabled via its control register. The simulator supports the
+arithmetic and logical instructions, JMP, JAL, LDI, LMBD, the quick
+branch instructions, LBBO, SBBO, LBCO, SBCO (including the programmable
+constant table entries), ZERO, FILL, HALT and SLP. Each instruction takes one cycle, and loads
+stall for one cycle for each 32 bit word that is read; the cycle and stall
+counters in the control registers are updated accordingly.
+Writing R31 with bit 5 set raises the system event 16 + bits 0-3, and
+R31 reads return the inputs set by SetInputs along with the status of host
+interrupts 0 and 1. An unsupported instruction halts the core, and
+the cause can be retrieved using Error.
+*/
+package sim
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	memSize  = 0x80000    // Size of the PRU-ICSS address space
+	nSignals = 8          // Number of host interrupts routed to the CPU
+	revision = 0x4E82A900 // Revision ID of the AM33xx PRU-ICSS
+
+	rREVID = 0x20000
+)
+
+// Sim is a software model of the PRU-ICSS subsystem.
+type Sim struct {
+	mu      sync.Mutex
+	mem     []byte
+	intc    intc
+	cores   [nUnits]*core
+	done    chan struct{}
+	signals [nSignals]*os.File // Simulator end of the signal devices
+	count   [nSignals]uint32   // Interrupt count for each signal
+}
+
+// New creates a simulated PRU-ICSS subsystem.
+func New() *Sim {
+	s := new(Sim)
+	s.mem = make([]byte, memSize)
+	s.done = make(chan struct{})
+	s.store(rREVID, revision)
+	s.updateIntc()
+	s.cores[0] = newCore(s, pru0Ram, pru1Ram, pru0Ctl, pru0Dbg, pru0Iram)
+	s.cores[1] = newCore(s, pru1Ram, pru0Ram, pru1Ctl, pru1Dbg, pru1Iram)
+	for _, c := range s.cores {
+		go c.run()
+	}
+	return s
+}
+
+// Memory returns the byte slice representing the PRU-ICSS address space.
+func (s *Sim) Memory() []byte {
+	return s.mem
+}
+
+// Load reads one 32 bit word from the memory.
+func (s *Sim) Load(offs uintptr) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&s.mem[offs])))
+}
+
+// Store writes one 32 bit word to the memory. Writes to the
+// interrupt controller and control registers update the models of the
+// interrupt controller and PRU cores.
+func (s *Sim) Store(offs uintptr, v uint32) {
+	s.mu.Lock()
+	s.storeLocked(offs, v)
+	s.mu.Unlock()
+}
+
+// storeLocked writes one 32 bit word to the memory.
+// The lock must be held.
+func (s *Sim) storeLocked(offs uintptr, v uint32) {
+	switch {
+	case offs >= intcBase && offs < intcEnd:
+		s.storeIntc(offs, v)
+	case offs >= pru0Ctl && offs < pru0Ctl+ctlSize:
+		s.cores[0].storeCtl(offs-pru0Ctl, v)
+	case offs >= pru1Ctl && offs < pru1Ctl+ctlSize:
+		s.cores[1].storeCtl(offs-pru1Ctl, v)
+	case offs >= pru0Dbg+ctRegOffs && offs < pru0Dbg+dbgSize,
+		offs >= pru1Dbg+ctRegOffs && offs < pru1Dbg+dbgSize:
+		// Constant table is read only.
+	default:
+		s.store(offs, v)
+	}
+}
+
+// store writes one 32 bit word to the memory without side effects.
+func (s *Sim) store(offs uintptr, v uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&s.mem[offs])), v)
+}
+
+// Signal creates a simulated event device for the signal.
+// The device is one end of a socket pair, so that reading the
+// device blocks until an interrupt is raised. As with the hardware,
+// the host interrupt is disabled (its HIER bit is cleared) when raised,
+// and must be re-enabled via HIEISR. Writes to the device are discarded.
+func (s *Sim) Signal(sig int) (*os.File, error) {
+	if sig < 0 || sig >= nSignals {
+		return nil, fmt.Errorf("signal %d out of range", sig)
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range fds {
+		unix.CloseOnExec(fd)
+		if err := unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fds[0])
+			unix.Close(fds[1])
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signals[sig] != nil {
+		s.signals[sig].Close()
+	}
+	f := os.NewFile(uintptr(fds[0]), fmt.Sprintf("sim-uio%d", sig))
+	s.signals[sig] = f
+	go drain(f)
+	return os.NewFile(uintptr(fds[1]), fmt.Sprintf("/dev/uio%d", sig)), nil
+}
+
+// drain discards the writes to the signal device (which re-enable the interrupt)
+// until the device is closed.
+func drain(f *os.File) {
+	b := make([]byte, 4)
+	for {
+		if _, err := f.Read(b); err != nil {
+			return
+		}
+	}
+}
+
+// interrupt increments the interrupt count of the signal, and
+// writes the count to the signal device if it is open.
+// The lock must be held.
+func (s *Sim) interrupt(sig int) {
+	s.count[sig]++
+	if f := s.signals[sig]; f != nil {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, s.count[sig])
+		f.Write(b)
+	}
+}
+
+// Close stops the PRU cores and releases the simulated devices.
+func (s *Sim) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	for i, f := range s.signals {
+		if f != nil {
+			f.Close()
+			s.signals[i] = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aamcrae/pru"
+	"github.com/aamcrae/pru/asm"
+	"github.com/aamcrae/pru/sim"
+)
+
+// Timeout used when waiting for events or for a unit to halt.
+const testTimeout = 2 * time.Second
+
+// openSim opens the PRU on a simulator using the configuration.
+// The PRU is closed when the test completes.
+func openSim(t *testing.T, pc *pru.Config) (*sim.Sim, *pru.PRU) {
+	t.Helper()
+	s := sim.New()
+	p, err := pru.OpenWithBackend(pc, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return s, p
+}
+
+// waitHalt waits for the unit to halt.
+func waitHalt(t *testing.T, u *pru.Unit) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for u.IsRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("unit did not halt")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoadRun(t *testing.T) {
+	_, p := openSim(t, pru.DefaultConfig)
+	u := p.Unit(0)
+	// The program reads the address of the control registers from RAM.
+	p.Order.PutUint32(u.Ram[0:], 0x00022000)
+	if err := u.LoadAndRunFile("../examples/counter/prucounter.bin"); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u)
+	if v := p.Order.Uint32(u.Ram[4:]); v != 202 {
+		t.Errorf("cycle count: got %d, want 202", v)
+	}
+}
+
+func TestDual(t *testing.T) {
+	_, p := openSim(t, pru.DefaultConfig)
+	u := p.Unit(1)
+	// The program copies words from its RAM to the shared RAM, and then sends event 19.
+	for i, v := range []uint32{3, 4, 0x100, 0x10000} {
+		p.Order.PutUint32(u.Ram[i*4:], v)
+	}
+	for i := 0; i < 4; i++ {
+		p.Order.PutUint32(u.Ram[0x100+i*4:], uint32(i+10))
+	}
+	if err := u.LoadAndRunFile("../examples/dual/prucode.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := p.Event(19).WaitTimeout(testTimeout); err != nil || !ok {
+		t.Fatalf("event 19: not received (%v)", err)
+	}
+	for i := 0; i < 4; i++ {
+		if v := p.Order.Uint32(p.SharedRam[i*4:]); v != uint32(i+10) {
+			t.Errorf("shared RAM word %d: got %d, want %d", i, v, i+10)
+		}
+	}
+}
+
+func TestGpio(t *testing.T) {
+	s, p := openSim(t, pru.DefaultConfig)
+	u := p.Unit(0)
+	// The program copies input 15 to output 15 until host interrupt 1 (R31 bit 31)
+	// is set, and then sends event 19.
+	for i, v := range []uint32{3, 31, 1, 0, 15, 15} {
+		p.Order.PutUint32(u.Ram[i*4:], v)
+	}
+	if err := u.LoadAndRunFile("../examples/gpio/prugpio.bin"); err != nil {
+		t.Fatal(err)
+	}
+	waitOutputs := func(want uint32) {
+		t.Helper()
+		deadline := time.Now().Add(testTimeout)
+		for s.Outputs(0) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("outputs: got %#x, want %#x", s.Outputs(0), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	s.SetInputs(0, 1<<15)
+	waitOutputs(1 << 15)
+	s.SetInputs(0, 0)
+	waitOutputs(0)
+	// Event 17 is mapped to host interrupt 1.
+	p.SendEvent(17)
+	if ok, err := p.Event(19).WaitTimeout(testTimeout); err != nil || !ok {
+		t.Fatalf("event 19: not received (%v)", err)
+	}
+	waitHalt(t, u)
+	if err := s.Error(0); err != nil {
+		t.Errorf("simulator: %v", err)
+	}
+}
+
+func TestZeroFill(t *testing.T) {
+	_, p := openSim(t, pru.DefaultConfig)
+	u := p.Unit(0)
+	prog, err := asm.Assemble("zero.p", []byte(`
+	LDI	r0, 0
+	FILL	&r1, 12
+	ZERO	&r2.b1, 2
+	SBBO	&r1, r0, 0, 12
+	HALT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.LoadAndRun(prog.Code); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u)
+	want := []uint32{0xFFFFFFFF, 0xFF0000FF, 0xFFFFFFFF}
+	for i, w := range want {
+		if v := p.Order.Uint32(u.Ram[i*4:]); v != w {
+			t.Errorf("r%d: got %#x, want %#x", i+1, v, w)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	s, p := openSim(t, pru.DefaultConfig)
+	u := p.Unit(0)
+	// XOUT to the scratch pad, which is not simulated.
+	if err := u.LoadAndRun([]uint32{0x240001e1, 0x2f050181}); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u)
+	if err := s.Error(0); err == nil {
+		t.Errorf("expected simulator error")
+	}
+	if err := s.Error(1); err != nil {
+		t.Errorf("unit 1: unexpected error %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	snapshotMagic   = "PRUS"
+	snapshotVersion = 1
+)
+
+// Snapshot holds the state of a halted unit, along with the shared RAM.
+// A snapshot is stored in a file as a header containing the magic string "PRUS" and
+// a 32 bit version number, followed by the fields of the Snapshot in order, all little-endian.
+type Snapshot struct {
+	Unit      uint32                    // Index of the unit
+	PC        uint32                    // Byte address of the next instruction
+	Control   uint32                    // CONTROL register
+	WakeupEn  uint32                    // WAKEUP_EN register
+	Cycles    uint32                    // Cycle counter
+	Stalls    uint32                    // Stall counter
+	CTBIR     [2]uint32                 // Constant table block index registers
+	CTPPR     [2]uint32                 // Constant table programmable pointer registers
+	Registers [32]uint32                // General purpose registers
+	IRAM      [am3xxIRamSize / 4]uint32 // Instruction RAM
+	Ram       [am3xxRamSize]byte        // Unit data RAM
+	SharedRam [am3xxSharedRamSize]byte  // Shared RAM
+}
+
+// Snapshot captures the state of the unit and the shared RAM.
+// The unit must not be running.
+func (u *Unit) Snapshot() (*Snapshot, error) {
+	if u.IsRunning() {
+		return nil, fmt.Errorf("unit %d is running", u.index)
+	}
+	s := new(Snapshot)
+	s.Unit = uint32(u.index)
+	s.PC = uint32(u.PC())
+	s.Control = u.pru.rd(u.ctlBase + c_CONTROL)
+	s.WakeupEn = u.pru.rd(u.ctlBase + c_WAKEUP_EN)
+	s.Cycles = u.Cycles()
+	s.Stalls = u.Stalls()
+	s.CTBIR[0] = u.pru.rd(u.ctlBase + c_CTBIR0)
+	s.CTBIR[1] = u.pru.rd(u.ctlBase + c_CTBIR1)
+	s.CTPPR[0] = u.pru.rd(u.ctlBase + c_CTPPR0)
+	s.CTPPR[1] = u.pru.rd(u.ctlBase + c_CTPPR1)
+	u.pru.read(u.dbgBase+d_GPREG0, s.Registers[:])
+	u.pru.read(u.iram, s.IRAM[:])
+	copy(s.Ram[:], u.Ram)
+	copy(s.SharedRam[:], u.pru.SharedRam)
+	return s, nil
+}
+
+// Restore restores the state of the unit and the shared RAM from the snapshot.
+// The snapshot may have been taken from either unit. The unit is left halted
+// at the PC of the snapshot, so that execution can be continued using Resume or Step.
+func (u *Unit) Restore(s *Snapshot) error {
+	if s.PC%4 != 0 || s.PC >= am3xxIRamSize {
+		return fmt.Errorf("invalid PC 0x%04x in snapshot", s.PC)
+	}
+	if err := u.LoadAt(s.IRAM[:], 0); err != nil {
+		return err
+	}
+	copy(u.Ram, s.Ram[:])
+	copy(u.pru.SharedRam, s.SharedRam[:])
+	// A soft reset loads the PC from the reset value. The counters are disabled
+	// so that they can be written.
+	pc := s.PC << (16 - 2)
+	u.pru.wr(u.ctlBase+c_CONTROL, pc)
+	u.pru.wr(u.ctlBase+c_CONTROL, pc|ctl_RESET)
+	u.pru.wr(u.ctlBase+c_CYCLE, s.Cycles)
+	u.pru.wr(u.ctlBase+c_STALL, s.Stalls)
+	u.pru.wr(u.ctlBase+c_WAKEUP_EN, s.WakeupEn)
+	u.pru.wr(u.ctlBase+c_CTBIR0, s.CTBIR[0])
+	u.pru.wr(u.ctlBase+c_CTBIR1, s.CTBIR[1])
+	u.pru.wr(u.ctlBase+c_CTPPR0, s.CTPPR[0])
+	u.pru.wr(u.ctlBase+c_CTPPR1, s.CTPPR[1])
+	u.pru.write(s.Registers[:], u.dbgBase+d_GPREG0)
+	u.counter = s.Control & ctl_COUNTER_EN
+	u.pru.wr(u.ctlBase+c_CONTROL, pc|ctl_RESET|u.counter)
+	return nil
+}
+
+// Write writes the snapshot in the versioned snapshot file format.
+func (s *Snapshot) Write(w io.Writer) error {
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(snapshotVersion)); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, s)
+}
+
+// ReadSnapshot reads a snapshot written by Snapshot.Write.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var hdr [len(snapshotMagic) + 4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if string(hdr[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("not a snapshot file")
+	}
+	if v := binary.LittleEndian.Uint32(hdr[len(snapshotMagic):]); v != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	s := new(Snapshot)
+	if err := binary.Read(r, binary.LittleEndian, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SaveSnapshotFile captures the state of the unit and the shared RAM,
+// and writes it to the named file. The unit must not be running.
+func (u *Unit) SaveSnapshotFile(name string) error {
+	s, err := u.Snapshot()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = s.Write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// RestoreSnapshotFile reads a snapshot from the named file and restores it to the unit.
+func (u *Unit) RestoreSnapshotFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s, err := ReadSnapshot(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	return u.Restore(s)
+}
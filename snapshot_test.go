@@ -0,0 +1,187 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Test program that sets r1, r2 and r3 in turn.
+var regsProg = []uint32{
+	0x240001e1, // LDI r1, 1
+	0x240002e2, // LDI r2, 2
+	0x240003e3, // LDI r3, 3
+	0x2a000000, // HALT
+}
+
+// stepTo loads the program and single steps the unit to the address.
+func stepTo(t *testing.T, u *Unit, addr uint) {
+	t.Helper()
+	if err := u.LoadAt(regsProg, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetPC(0); err != nil {
+		t.Fatal(err)
+	}
+	for u.PC() != addr {
+		if err := u.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	u.EnableCounters(true)
+	stepTo(t, u, 8)
+	u.Ram[5] = 7
+	p.SharedRam[9] = 8
+	u.SetConstBlock(24, 4)
+	u.SetWakeupMask(0x10)
+	s, err := u.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.PC != 8 || s.Registers[1] != 1 || s.Registers[2] != 2 || s.Cycles != 2 {
+		t.Errorf("snapshot: got PC %d, r1 %d, r2 %d, %d cycles", s.PC, s.Registers[1], s.Registers[2], s.Cycles)
+	}
+	var b bytes.Buffer
+	if err := s.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := ReadSnapshot(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rs, s) {
+		t.Errorf("snapshot changed by Write and ReadSnapshot")
+	}
+	// Change the state, and restore it to the other unit.
+	u.LoadAt([]uint32{0, 0, 0, 0}, 0)
+	u.Ram[5] = 0
+	p.SharedRam[9] = 0
+	u1 := p.Unit(1)
+	if err := u1.Restore(rs); err != nil {
+		t.Fatal(err)
+	}
+	if pc := u1.PC(); pc != 8 {
+		t.Errorf("restored PC: got %d, want 8", pc)
+	}
+	if u1.Ram[5] != 7 || p.SharedRam[9] != 8 {
+		t.Errorf("restored RAM: got %d, %d, want 7, 8", u1.Ram[5], p.SharedRam[9])
+	}
+	if b, _ := u1.ConstBlock(24); b != 4 {
+		t.Errorf("restored C24 block: got %d, want 4", b)
+	}
+	if m := u1.WakeupMask(); m != 0x10 {
+		t.Errorf("restored wakeup mask: got %#x, want 0x10", m)
+	}
+	if c := u1.Cycles(); c != 2 {
+		t.Errorf("restored cycles: got %d, want 2", c)
+	}
+	// Execution continues from the restored PC, with the counters enabled.
+	if err := u1.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u1)
+	r, err := u1.Registers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r[1] != 1 || r[2] != 2 || r[3] != 3 {
+		t.Errorf("registers: got %d %d %d, want 1 2 3", r[1], r[2], r[3])
+	}
+	if c := u1.Cycles(); c != 4 {
+		t.Errorf("cycles after resume: got %d, want 4", c)
+	}
+	if err := u1.LoadAndRun([]uint32{0x79000000}); err != nil { // QBA 0
+		t.Fatal(err)
+	}
+	if _, err := u1.Snapshot(); err == nil {
+		t.Errorf("Snapshot of running unit: expected error")
+	}
+	rs.PC = 2
+	if err := u.Restore(rs); err == nil {
+		t.Errorf("Restore with unaligned PC: expected error")
+	}
+	rs.PC = am3xxIRamSize
+	if err := u.Restore(rs); err == nil {
+		t.Errorf("Restore with PC beyond IRAM: expected error")
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	stepTo(t, u, 4)
+	f := filepath.Join(t.TempDir(), "unit.snap")
+	if err := u.SaveSnapshotFile(f); err != nil {
+		t.Fatal(err)
+	}
+	stepTo(t, u, 12)
+	if err := u.RestoreSnapshotFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if pc := u.PC(); pc != 4 {
+		t.Errorf("restored PC: got %d, want 4", pc)
+	}
+	if r, _ := u.Register(2); r != 0 {
+		t.Errorf("restored r2: got %d, want 0", r)
+	}
+	if err := u.RestoreSnapshotFile(filepath.Join(t.TempDir(), "missing.snap")); err == nil {
+		t.Errorf("missing file: expected error")
+	}
+	if err := u.SaveSnapshotFile(filepath.Join(t.TempDir(), "missing", "unit.snap")); err == nil {
+		t.Errorf("invalid file name: expected error")
+	}
+}
+
+func TestReadSnapshotInvalid(t *testing.T) {
+	var b bytes.Buffer
+	if err := new(Snapshot).Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	valid := b.Bytes()
+	version := func(v uint32) []byte {
+		f := append([]byte(nil), valid...)
+		binary.LittleEndian.PutUint32(f[4:], v)
+		return f
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", valid[:6]},
+		{"bad magic", append([]byte("PRUX"), valid[4:]...)},
+		{"version 0", version(0)},
+		{"version 2", version(2)},
+		{"header only", valid[:8]},
+		{"truncated", valid[:len(valid)-1]},
+	}
+	for _, tc := range tests {
+		if _, err := ReadSnapshot(bytes.NewReader(tc.data)); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+	if _, err := ReadSnapshot(bytes.NewReader(valid)); err != nil {
+		t.Errorf("valid snapshot: %v", err)
+	}
+}
@@ -15,9 +15,13 @@
 package pru
 
 import (
-	"encoding/binary"
+	"context"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"runtime"
+	"time"
 )
 
 const (
@@ -32,6 +36,15 @@ const (
 	c_CTPPR0    = 0x28
 	c_CTPPR1    = 0x2C
 )
+const (
+	// Debug registers offset
+	d_GPREG0  = 0x00
+	d_CT_REG0 = 0x80
+)
+
+// Maximum time for a single step to complete.
+const stepTimeout = 100 * time.Millisecond
+
 const (
 	ctl_RESET       = 0x0001
 	ctl_ENABLE      = 0x0002
@@ -44,31 +57,69 @@ const (
 // Unit represents one PRU (core) of the PRU-ICSS subsystem
 type Unit struct {
 	pru     *PRU
+	index   int
 	iram    uintptr
 	ctlBase uintptr
+	dbgBase uintptr
+	counter uint32 // ctl_COUNTER_EN if the counters are enabled
 
 	Ram          ram  // PRU unit data ram
 }
 
-// newUnit initialises the unit's fields
-func newUnit(p *PRU, ram, iram, ctl uintptr) *Unit {
+// newUnit initialises the unit's fields, and resets the unit unless
+// the unit is to be left in its current state.
+func newUnit(p *PRU, index int, ram, iram, ctl, dbg uintptr) *Unit {
 	u := new(Unit)
 	u.pru = p
+	u.index = index
 	u.ctlBase = ctl
+	u.dbgBase = dbg
 	u.Ram = p.mem[ram : ram+am3xxRamSize]
 	u.iram = iram
-	u.Reset()
+	if p.noReset {
+		u.counter = p.rd(u.ctlBase+c_CONTROL) & ctl_COUNTER_EN
+	} else {
+		u.Reset()
+	}
 	return u
 }
 
 // Reset resets the PRU unit
 func (u *Unit) Reset() {
+	u.rprocStop()
+	u.counter = 0
 	u.pru.wr(u.ctlBase+c_CONTROL, 0)
 }
 
 // Disable disables this PRU unit
 func (u *Unit) Disable() {
-	u.pru.wr(u.ctlBase+c_CONTROL, ctl_RESET)
+	u.rprocStop()
+	u.pru.wr(u.ctlBase+c_CONTROL, ctl_RESET|u.counter)
+}
+
+// rprocStop stops the unit if it is running firmware under RemoteProc control,
+// and removes the rpmsg devices that were provided by the firmware.
+func (u *Unit) rprocStop() {
+	if u.pru.rproc != nil && u.pru.rproc.procs[u.index] != "" {
+		u.pru.rproc.stop(u.index)
+		u.pru.syncRpmsg()
+	}
+}
+
+// LoadFirmware loads and runs the firmware file (an ELF executable) on the unit
+// using the RemoteProc driver. The file is copied to /lib/firmware if it is
+// not already located there. This can only be used if the PRU
+// cores are managed by the RemoteProc driver.
+// Once the firmware is started, the rpmsg devices in the configuration are
+// (re)opened, waiting up to 1 second for the devices to be created.
+func (u *Unit) LoadFirmware(fw string) error {
+	if u.pru.rproc == nil {
+		return fmt.Errorf("RemoteProc driver not in use")
+	}
+	if err := u.pru.rproc.start(u.index, fw); err != nil {
+		return err
+	}
+	return u.pru.waitRpmsg()
 }
 
 // IsRunning returns true if the PRU is enabled and running.
@@ -76,6 +127,33 @@ func (u *Unit) IsRunning() bool {
 	return (u.pru.rd(u.ctlBase+c_CONTROL) & ctl_RUNSTATE) != 0
 }
 
+// IsSleeping returns true if the unit has executed a SLP instruction and
+// has not yet been woken.
+func (u *Unit) IsSleeping() bool {
+	return (u.pru.rd(u.ctlBase+c_CONTROL) & ctl_SLEEPING) != 0
+}
+
+// SetWakeupMask sets the WAKEUP_EN register, which selects the bits of
+// register R31 (the status inputs) that wake the unit from a SLP instruction.
+func (u *Unit) SetWakeupMask(mask uint32) {
+	u.pru.wr(u.ctlBase+c_WAKEUP_EN, mask)
+}
+
+// WakeupMask returns the value of the WAKEUP_EN register.
+func (u *Unit) WakeupMask() uint32 {
+	return u.pru.rd(u.ctlBase + c_WAKEUP_EN)
+}
+
+// Wake wakes the unit if it is sleeping, so that execution continues
+// with the instruction following the SLP instruction.
+func (u *Unit) Wake() {
+	ctl := u.pru.rd(u.ctlBase + c_CONTROL)
+	if (ctl & ctl_SLEEPING) != 0 {
+		// Writing 0 to the sleeping bit wakes the unit.
+		u.pru.wr(u.ctlBase+c_CONTROL, ctl&^ctl_SLEEPING)
+	}
+}
+
 // Run enables the PRU core to run at address 0.
 func (u *Unit) Run() error {
 	return u.RunAt(0)
@@ -92,9 +170,219 @@ func (u *Unit) RunAt(addr uint) error {
 	}
 	u.Disable()
 	// Upper 16 bits is instruction word address.
-	u.pru.wr(u.ctlBase+c_CONTROL, (uint32(addr) << (16-2)) | ctl_ENABLE)
+	u.pru.wr(u.ctlBase+c_CONTROL, (uint32(addr)<<(16-2))|ctl_ENABLE|u.counter)
+	return nil
+}
+
+// PC returns the byte address of the instruction that the unit will execute
+// next (or is executing, if the unit is running), read from the STATUS register.
+func (u *Unit) PC() uint {
+	return uint(u.pru.rd(u.ctlBase+c_STATUS)&0xFFFF) * 4
+}
+
+// SetPC sets the program counter of a halted unit to the byte address (which
+// must be 32 bit aligned). A soft reset is used to load the program counter, and the unit is
+// left halted, so that execution can be continued from the address using Resume or Step.
+func (u *Unit) SetPC(addr uint) error {
+	if (addr % 4) != 0 {
+		return fmt.Errorf("address is not 32 bit aligned")
+	}
+	if addr >= am3xxIRamSize {
+		return fmt.Errorf("address out of range")
+	}
+	if u.IsRunning() {
+		return fmt.Errorf("unit %d is running", u.index)
+	}
+	// A soft reset loads the PC from the reset value (the upper 16 bits).
+	pc := uint32(addr) << (16 - 2)
+	u.pru.wr(u.ctlBase+c_CONTROL, pc|u.counter)
+	u.pru.wr(u.ctlBase+c_CONTROL, pc|ctl_RESET|u.counter)
 	return nil
 }
+
+// Halt disables the unit, preserving the program counter
+// so that execution can be continued using Resume or Step.
+func (u *Unit) Halt() {
+	ctl := u.pru.rd(u.ctlBase + c_CONTROL)
+	u.pru.wr(u.ctlBase+c_CONTROL, (ctl|ctl_RESET)&^(ctl_ENABLE|ctl_SINGLE_STEP))
+}
+
+// Resume continues execution of a halted unit from the current program counter.
+func (u *Unit) Resume() error {
+	ctl := u.pru.rd(u.ctlBase + c_CONTROL)
+	if (ctl & ctl_RUNSTATE) != 0 {
+		return fmt.Errorf("unit %d is running", u.index)
+	}
+	u.pru.wr(u.ctlBase+c_CONTROL, (ctl|ctl_RESET|ctl_ENABLE)&^ctl_SINGLE_STEP)
+	return nil
+}
+
+// Step executes a single instruction of a halted unit at the current program counter,
+// waiting for the instruction to complete.
+func (u *Unit) Step() error {
+	ctl := u.pru.rd(u.ctlBase + c_CONTROL)
+	if (ctl & ctl_RUNSTATE) != 0 {
+		return fmt.Errorf("unit %d is running", u.index)
+	}
+	u.pru.wr(u.ctlBase+c_CONTROL, ctl|ctl_RESET|ctl_ENABLE|ctl_SINGLE_STEP)
+	// The unit is disabled when the instruction completes.
+	deadline := time.Now().Add(stepTimeout)
+	for u.IsRunning() {
+		if time.Now().After(deadline) {
+			u.Halt()
+			return fmt.Errorf("unit %d: step did not complete", u.index)
+		}
+		runtime.Gosched()
+	}
+	ctl = u.pru.rd(u.ctlBase + c_CONTROL)
+	u.pru.wr(u.ctlBase+c_CONTROL, ctl&^ctl_SINGLE_STEP)
+	return nil
+}
+
+// EnableCounters enables or disables the cycle and stall counters.
+// The counters remain enabled when the unit is run, halted or disabled,
+// until they are disabled or the unit is reset.
+// The hardware stops the counters when the cycle counter reaches 0xFFFFFFFF.
+func (u *Unit) EnableCounters(enable bool) {
+	if enable {
+		u.counter = ctl_COUNTER_EN
+	} else {
+		u.counter = 0
+	}
+	ctl := u.pru.rd(u.ctlBase + c_CONTROL)
+	u.pru.wr(u.ctlBase+c_CONTROL, (ctl&^ctl_COUNTER_EN)|u.counter)
+}
+
+// ResetCounters clears the cycle and stall counters.
+func (u *Unit) ResetCounters() {
+	// The counters can only be written when they are disabled.
+	ctl := u.pru.rd(u.ctlBase + c_CONTROL)
+	u.pru.wr(u.ctlBase+c_CONTROL, ctl&^ctl_COUNTER_EN)
+	u.pru.wr(u.ctlBase+c_CYCLE, 0)
+	u.pru.wr(u.ctlBase+c_STALL, 0)
+	u.pru.wr(u.ctlBase+c_CONTROL, (ctl&^ctl_COUNTER_EN)|u.counter)
+}
+
+// Cycles returns the number of cycles counted since the counters were reset.
+func (u *Unit) Cycles() uint32 {
+	return u.pru.rd(u.ctlBase + c_CYCLE)
+}
+
+// Stalls returns the number of cycles that the unit was stalled
+// since the counters were reset.
+func (u *Unit) Stalls() uint32 {
+	return u.pru.rd(u.ctlBase + c_STALL)
+}
+
+// Elapsed returns the execution time counted by the cycle counter.
+func (u *Unit) Elapsed() time.Duration {
+	// 200 MHz instruction rate. Duration is not used, since int may be 32 bits.
+	return time.Duration(u.Cycles()) * 5 * time.Nanosecond
+}
+
+// WaitHalt waits for the unit to halt (e.g by executing a HALT instruction),
+// polling the unit's status at the interval set by Config.HaltPoll.
+// The final PC (the byte address of the halting instruction) and the cycle counter are returned.
+// If the context is cancelled or its deadline expires before the unit halts,
+// the unit is left running and the context's error is returned.
+func (u *Unit) WaitHalt(ctx context.Context) (uint, uint32, error) {
+	return u.waitHalt(ctx, nil)
+}
+
+// WaitHaltEvent waits for the unit to halt, as WaitHalt does, and also checks the unit's status
+// whenever the event is received, so that a program that signals the event before halting
+// is detected without waiting for the poll interval.
+// Events received while waiting are consumed, and ErrClosed is returned
+// if the PRU is closed. This cannot be used if a handler
+// has been installed on the event.
+func (u *Unit) WaitHaltEvent(ctx context.Context, e *Event) (uint, uint32, error) {
+	if e.handlerRegistered {
+		return 0, 0, fmt.Errorf("Handler registered, cannot use WaitHaltEvent")
+	}
+	return u.waitHalt(ctx, e)
+}
+
+// waitHalt polls the unit until it halts, the event channel (if any) is read,
+// or the context is done.
+func (u *Unit) waitHalt(ctx context.Context, e *Event) (uint, uint32, error) {
+	var ev chan EventInfo
+	var done chan struct{}
+	if e != nil {
+		ev, done = e.evChan, e.done
+	}
+	ticker := time.NewTicker(u.pru.haltPoll)
+	defer ticker.Stop()
+	for u.IsRunning() {
+		select {
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
+		case <-ticker.C:
+		case <-ev:
+		case <-done:
+			return 0, 0, ErrClosed
+		}
+	}
+	return u.PC(), u.Cycles(), nil
+}
+
+// ctField returns the control register offset and bit shift of the
+// programmable constant table entry c (C24 to C31).
+func ctField(c int) (uintptr, uint) {
+	return c_CTBIR0 + uintptr((c-24)/2*4), uint(c%2) * 16
+}
+
+// setConst writes the field of the programmable constant table entry.
+func (u *Unit) setConst(c int, v, mask uint32) {
+	offs, shift := ctField(c)
+	r := u.pru.rd(u.ctlBase + offs)
+	u.pru.wr(u.ctlBase+offs, (r&^(mask<<shift))|(v&mask)<<shift)
+}
+
+// getConst reads the field of the programmable constant table entry.
+func (u *Unit) getConst(c int, mask uint32) uint32 {
+	offs, shift := ctField(c)
+	return (u.pru.rd(u.ctlBase+offs) >> shift) & mask
+}
+
+// SetConstBlock sets the block index of the constant table entry c (C24 to C27),
+// held in the CTBIR0 and CTBIR1 registers. The entry points to
+// the local memory at the block index multiplied by 256 e.g setting the block index
+// of C24 to 2 sets C24 to 0x00000200 (in the unit's data RAM).
+func (u *Unit) SetConstBlock(c int, index uint8) error {
+	if c < 24 || c > 27 {
+		return fmt.Errorf("constant table entry %d has no block index", c)
+	}
+	u.setConst(c, uint32(index), 0xFF)
+	return nil
+}
+
+// ConstBlock returns the block index of the constant table entry c (C24 to C27).
+func (u *Unit) ConstBlock(c int) (uint8, error) {
+	if c < 24 || c > 27 {
+		return 0, fmt.Errorf("constant table entry %d has no block index", c)
+	}
+	return uint8(u.getConst(c, 0xFF)), nil
+}
+
+// SetConstPointer sets the pointer of the constant table entry c (C28 to C31),
+// held in the CTPPR0 and CTPPR1 registers. The pointer is bits 23-8 of the
+// address e.g setting the pointer of C28 to 0x0100 sets C28 to 0x00010000 (the shared RAM).
+func (u *Unit) SetConstPointer(c int, ptr uint16) error {
+	if c < 28 || c > 31 {
+		return fmt.Errorf("constant table entry %d has no pointer", c)
+	}
+	u.setConst(c, uint32(ptr), 0xFFFF)
+	return nil
+}
+
+// ConstPointer returns the pointer of the constant table entry c (C28 to C31).
+func (u *Unit) ConstPointer(c int) (uint16, error) {
+	if c < 28 || c > 31 {
+		return 0, fmt.Errorf("constant table entry %d has no pointer", c)
+	}
+	return uint16(u.getConst(c, 0xFFFF)), nil
+}
+
 // Load the program from a file to instruction address 0.
 func (u *Unit) LoadFile(s string) error {
 	return u.LoadFileAt(s, 0)
@@ -134,29 +422,144 @@ func (u *Unit) LoadFileAt(s string, addr uint) error {
 	if err != nil {
 		return err
 	}
-	fi, err := f.Stat()
+	defer f.Close()
+	return u.LoadFrom(f, addr)
+}
+
+// LoadFS loads the program from the named file in the file system
+// (such as an embed.FS) to the address specified.
+func (u *Unit) LoadFS(fsys fs.FS, name string, addr uint) error {
+	f, err := fsys.Open(name)
 	if err != nil {
 		return err
 	}
-	if (fi.Size() % 4) != 0 {
-		return fmt.Errorf("length is not 32 bit aligned")
+	defer f.Close()
+	return u.LoadFrom(f, addr)
+}
+
+// LoadFrom loads the program from the reader to the address specified.
+// The program is read and validated before the IRAM is written.
+func (u *Unit) LoadFrom(r io.Reader, addr uint) error {
+	if (addr % 4) != 0 {
+		return fmt.Errorf("load address is not 32 bit aligned")
+	}
+	if addr >= am3xxIRamSize {
+		return fmt.Errorf("load address out of range")
 	}
-	code := make([]uint32, fi.Size()/4)
-	err = binary.Read(f, u.pru.Order, code)
+	// Read at most one word more than will fit, to detect programs that are too large.
+	b, err := io.ReadAll(io.LimitReader(r, am3xxIRamSize+4))
 	if err != nil {
 		return err
 	}
+	if (len(b) % 4) != 0 {
+		return fmt.Errorf("length is not 32 bit aligned")
+	}
+	if uint(len(b)) > am3xxIRamSize-addr {
+		return fmt.Errorf("Program too large")
+	}
+	code := make([]uint32, len(b)/4)
+	for i := range code {
+		code[i] = u.pru.Order.Uint32(b[i*4:])
+	}
 	return u.LoadAt(code, addr)
 }
 
-// LoadAt loads the PRU code into the IRAM at the specified byte address.
+// LoadAt loads the PRU code into the IRAM at the specified byte address (which
+// must be 32 bit aligned).
+// If verification is enabled in the configuration, the IRAM is verified after loading.
 func (u *Unit) LoadAt(code []uint32, addr uint) error {
-	if uint(len(code) * 4) + addr > am3xxIRamSize {
+	if (addr % 4) != 0 {
+		return fmt.Errorf("load address is not 32 bit aligned")
+	}
+	if addr >= am3xxIRamSize {
+		return fmt.Errorf("load address out of range")
+	}
+	if uint(len(code)) > (am3xxIRamSize-addr)/4 {
 		return fmt.Errorf("Program too large")
 	}
 	// Ensure unit is not running before writing IRAM.
 	u.Disable()
 	// Copy to IRAM.
 	u.pru.write(code, u.iram + uintptr(addr))
+	if u.pru.verify {
+		return u.Verify(code, addr)
+	}
+	return nil
+}
+
+// ReadIRAM returns a snapshot of n instruction words read from the IRAM at the specified
+// byte address. The IRAM should only be read when the unit is not running.
+func (u *Unit) ReadIRAM(addr, n uint) ([]uint32, error) {
+	if (addr % 4) != 0 {
+		return nil, fmt.Errorf("address is not 32 bit aligned")
+	}
+	if addr >= am3xxIRamSize || n > (am3xxIRamSize-addr)/4 {
+		return nil, fmt.Errorf("read beyond end of IRAM")
+	}
+	code := make([]uint32, n)
+	u.pru.read(u.iram+uintptr(addr), code)
+	return code, nil
+}
+
+// Verify compares the IRAM at the specified byte address against the program,
+// returning an error identifying the first word that does not match.
+func (u *Unit) Verify(code []uint32, addr uint) error {
+	iram, err := u.ReadIRAM(addr, uint(len(code)))
+	if err != nil {
+		return err
+	}
+	for i, w := range code {
+		if iram[i] != w {
+			return fmt.Errorf("IRAM verify failed at address 0x%04x: expected 0x%08x, read 0x%08x", addr+uint(i)*4, w, iram[i])
+		}
+	}
+	return nil
+}
+
+// Registers returns the general purpose registers R0 to R31, read
+// via the debug registers. The unit must not be running.
+func (u *Unit) Registers() ([32]uint32, error) {
+	var r [32]uint32
+	if u.IsRunning() {
+		return r, fmt.Errorf("unit %d is running", u.index)
+	}
+	u.pru.read(u.dbgBase+d_GPREG0, r[:])
+	return r, nil
+}
+
+// Register returns the value of general purpose register n.
+// The unit must not be running.
+func (u *Unit) Register(n int) (uint32, error) {
+	if n < 0 || n >= 32 {
+		return 0, fmt.Errorf("invalid register %d", n)
+	}
+	if u.IsRunning() {
+		return 0, fmt.Errorf("unit %d is running", u.index)
+	}
+	return u.pru.rd(u.dbgBase + d_GPREG0 + uintptr(n*4)), nil
+}
+
+// SetRegister writes the value to general purpose register n.
+// The unit must not be running.
+func (u *Unit) SetRegister(n int, v uint32) error {
+	if n < 0 || n >= 32 {
+		return fmt.Errorf("invalid register %d", n)
+	}
+	if u.IsRunning() {
+		return fmt.Errorf("unit %d is running", u.index)
+	}
+	u.pru.wr(u.dbgBase+d_GPREG0+uintptr(n*4), v)
 	return nil
 }
+
+// Constants returns the entries of the constant table (C0 to C31) as seen by
+// the unit. The constant table is read-only; the programmable entries
+// are set via the CTBIR and CTPPR control registers. The unit must not be running.
+func (u *Unit) Constants() ([32]uint32, error) {
+	var c [32]uint32
+	if u.IsRunning() {
+		return c, fmt.Errorf("unit %d is running", u.index)
+	}
+	u.pru.read(u.dbgBase+d_CT_REG0, c[:])
+	return c, nil
+}
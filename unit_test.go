@@ -0,0 +1,630 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pru
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/aamcrae/pru/sim"
+)
+
+// Test program that stores 0x1234 in the first word of the unit's RAM.
+var storeProg = []uint32{
+	0x241234e1, // LDI r1, 0x1234
+	0xe1002081, // SBBO &r1, r0, 0, 4
+	0x2a000000, // HALT
+}
+
+// iram reads n words of the unit's IRAM at the byte address.
+func iram(u *Unit, addr, n uint) []uint32 {
+	code := make([]uint32, n)
+	u.pru.read(u.iram+uintptr(addr), code)
+	return code
+}
+
+// progBytes returns the program as bytes in the PRU's byte order.
+func progBytes(p *PRU, code []uint32) []byte {
+	b := make([]byte, len(code)*4)
+	for i, w := range code {
+		p.Order.PutUint32(b[i*4:], w)
+	}
+	return b
+}
+
+func TestLoadAt(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(1)
+	if err := u.LoadAndRunAt(storeProg, 0x200); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u)
+	if v := p.Order.Uint32(u.Ram[0:]); v != 0x1234 {
+		t.Errorf("RAM[0]: got %#x, want %#x", v, 0x1234)
+	}
+}
+
+func TestLoadFrom(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	if err := u.LoadFrom(bytes.NewReader(progBytes(p, storeProg)), 0x100); err != nil {
+		t.Fatal(err)
+	}
+	if got := iram(u, 0x100, 3); !reflect.DeepEqual(got, storeProg) {
+		t.Errorf("IRAM: got %08x, want %08x", got, storeProg)
+	}
+	fsys := fstest.MapFS{
+		"prog.bin":  {Data: progBytes(p, storeProg)},
+		"odd.bin":   {Data: []byte{1, 2, 3, 4, 5}},
+		"large.bin": {Data: make([]byte, am3xxIRamSize+4)},
+	}
+	if err := u.LoadFS(fsys, "prog.bin", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := iram(u, 0, 3); !reflect.DeepEqual(got, storeProg) {
+		t.Errorf("IRAM: got %08x, want %08x", got, storeProg)
+	}
+	for _, name := range []string{"odd.bin", "large.bin", "missing.bin"} {
+		if err := u.LoadFS(fsys, name, 0); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if err := u.LoadFS(fsys, "prog.bin", am3xxIRamSize-8); err == nil {
+		t.Errorf("program beyond end of IRAM: expected error")
+	}
+}
+
+// TestLoadRange checks that invalid addresses and sizes are rejected before the IRAM is written.
+func TestLoadRange(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	// The last word of unit 0's IRAM, and the word after it.
+	last := u.iram + am3xxIRamSize - 4
+	p.wr(last, 0x11111111)
+	p.wr(last+4, 0x22222222)
+	for _, addr := range []uint{2, am3xxIRamSize, ^uint(0) - 3, ^uint(0) &^ 3} {
+		if err := u.LoadAt([]uint32{1}, addr); err == nil {
+			t.Errorf("LoadAt %#x: expected error", addr)
+		}
+		if err := u.LoadFrom(bytes.NewReader([]byte{1, 0, 0, 0}), addr); err == nil {
+			t.Errorf("LoadFrom %#x: expected error", addr)
+		}
+	}
+	if err := u.LoadAt(make([]uint32, 2), am3xxIRamSize-4); err == nil {
+		t.Errorf("LoadAt beyond end of IRAM: expected error")
+	}
+	if p.rd(last) != 0x11111111 || p.rd(last+4) != 0x22222222 {
+		t.Errorf("memory written by a rejected load")
+	}
+	if err := u.LoadAt([]uint32{3}, am3xxIRamSize-4); err != nil {
+		t.Errorf("LoadAt last word: %v", err)
+	}
+}
+
+func TestReadIRAM(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	if err := u.LoadAt(storeProg, 0x40); err != nil {
+		t.Fatal(err)
+	}
+	code, err := u.ReadIRAM(0x40, uint(len(storeProg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(code, storeProg) {
+		t.Errorf("ReadIRAM: got %08x, want %08x", code, storeProg)
+	}
+	if _, err := u.ReadIRAM(0, am3xxIRamSize/4); err != nil {
+		t.Errorf("ReadIRAM of all IRAM: %v", err)
+	}
+	for _, r := range []struct{ addr, n uint }{
+		{2, 1},
+		{0, am3xxIRamSize/4 + 1},
+		{am3xxIRamSize, 1},
+		{4, ^uint(0)},
+		{^uint(0) &^ 3, 2},
+	} {
+		if _, err := u.ReadIRAM(r.addr, r.n); err == nil {
+			t.Errorf("ReadIRAM(%#x, %#x): expected error", r.addr, r.n)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	_, p := openSim(t, NewConfig().EnableUnit(0).VerifyLoad())
+	u := p.Unit(0)
+	if err := u.LoadAt(storeProg, 0x80); err != nil {
+		t.Fatalf("verified load: %v", err)
+	}
+	if err := u.Verify(storeProg, 0x80); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	// Corrupt the second word.
+	p.wr(u.iram+0x84, 0)
+	err := u.Verify(storeProg, 0x80)
+	if err == nil || !strings.Contains(err.Error(), "0x0084") {
+		t.Errorf("Verify of corrupted IRAM: got %v", err)
+	}
+	if err := u.Verify(storeProg, am3xxIRamSize-4); err == nil {
+		t.Errorf("Verify beyond end of IRAM: expected error")
+	}
+}
+
+// TestNoReset checks that a running unit is left running when the PRU is closed.
+func TestNoReset(t *testing.T) {
+	for _, noReset := range []bool{false, true} {
+		pc := NewConfig().EnableUnit(0)
+		if noReset {
+			pc.NoReset()
+		}
+		s := sim.New()
+		p, err := OpenWithBackend(pc, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The program loops forever (QBA 0).
+		if err := p.Unit(0).LoadAndRun([]uint32{0x79000000}); err != nil {
+			t.Fatal(err)
+		}
+		p.Close()
+		running := (s.Load(0x22000+c_CONTROL) & ctl_ENABLE) != 0
+		if running != noReset {
+			t.Errorf("NoReset %v: unit running %v after Close", noReset, running)
+		}
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	if err := u.LoadAndRun(storeProg); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u)
+	r, err := u.Registers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r[1] != 0x1234 {
+		t.Errorf("Registers r1: got %#x, want %#x", r[1], 0x1234)
+	}
+	if err := u.SetRegister(5, 0xdeadbeef); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := u.Register(5); err != nil || v != 0xdeadbeef {
+		t.Errorf("r5: got %#x (%v), want %#x", v, err, uint32(0xdeadbeef))
+	}
+	if r, err := u.Registers(); err != nil || r[5] != 0xdeadbeef {
+		t.Errorf("Registers r5: got %#x (%v), want %#x", r[5], err, uint32(0xdeadbeef))
+	}
+	for _, n := range []int{-1, 32} {
+		if _, err := u.Register(n); err == nil {
+			t.Errorf("Register(%d): expected error", n)
+		}
+		if err := u.SetRegister(n, 0); err == nil {
+			t.Errorf("SetRegister(%d): expected error", n)
+		}
+	}
+	c, err := u.Constants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// C0 is the fixed address of the interrupt controller.
+	if c[0] != 0x00020000 {
+		t.Errorf("C0: got %#x, want %#x", c[0], 0x00020000)
+	}
+	// The registers cannot be accessed while the unit is running.
+	if err := u.LoadAndRun([]uint32{0x79000000}); err != nil { // QBA 0
+		t.Fatal(err)
+	}
+	if _, err := u.Registers(); err == nil {
+		t.Errorf("Registers while running: expected error")
+	}
+	if _, err := u.Register(1); err == nil {
+		t.Errorf("Register while running: expected error")
+	}
+	if err := u.SetRegister(1, 0); err == nil {
+		t.Errorf("SetRegister while running: expected error")
+	}
+	if _, err := u.Constants(); err == nil {
+		t.Errorf("Constants while running: expected error")
+	}
+}
+
+func TestSetPC(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	if err := u.LoadAt(assemble(t, "LDI r1, 1\nHALT\nLDI r1, 2\nHALT\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetPC(8); err != nil {
+		t.Fatal(err)
+	}
+	if pc := u.PC(); pc != 8 {
+		t.Fatalf("PC: got %d, want 8", pc)
+	}
+	if err := u.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if pc := u.PC(); pc != 12 {
+		t.Errorf("PC after step: got %d, want 12", pc)
+	}
+	if r, err := u.Register(1); err != nil || r != 2 {
+		t.Errorf("r1: got %d (%v), want 2", r, err)
+	}
+	if err := u.SetPC(2); err == nil {
+		t.Errorf("unaligned SetPC: expected error")
+	}
+}
+
+func TestStep(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	prog := assemble(t, `
+	LDI	r1, 1
+loop:
+	ADD	r1, r1, 1
+	QBA	loop
+`)
+	if err := u.LoadAt(prog, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetPC(0); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct {
+		pc uint
+		r1 uint32
+	}{{4, 1}, {8, 2}, {4, 2}, {8, 3}} {
+		if err := u.Step(); err != nil {
+			t.Fatal(err)
+		}
+		if u.IsRunning() {
+			t.Fatalf("step %d: unit running", i)
+		}
+		if pc := u.PC(); pc != want.pc {
+			t.Errorf("step %d: PC got %d, want %d", i, pc, want.pc)
+		}
+		if r, err := u.Register(1); err != nil || r != want.r1 {
+			t.Errorf("step %d: r1 got %d (%v), want %d", i, r, err, want.r1)
+		}
+	}
+	if err := u.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if !u.IsRunning() {
+		t.Fatalf("unit not running after Resume")
+	}
+	if err := u.Step(); err == nil {
+		t.Errorf("Step while running: expected error")
+	}
+	if err := u.Resume(); err == nil {
+		t.Errorf("Resume while running: expected error")
+	}
+	if err := u.SetPC(0); err == nil {
+		t.Errorf("SetPC while running: expected error")
+	}
+	u.Halt()
+	if u.IsRunning() {
+		t.Fatalf("unit running after Halt")
+	}
+	if pc := u.PC(); pc != 4 && pc != 8 {
+		t.Errorf("PC after Halt: got %d", pc)
+	}
+	// Execution continues from the halted PC.
+	r1, err := u.Register(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1 < 3 {
+		t.Errorf("r1 after Resume: got %d, want at least 3", r1)
+	}
+	if err := u.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := u.Register(1); r != r1 && r != r1+1 {
+		t.Errorf("r1 after step: got %d, want %d or %d", r, r1, r1+1)
+	}
+	if err := u.SetPC(am3xxIRamSize); err == nil {
+		t.Errorf("SetPC beyond IRAM: expected error")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	// 5 cycles, including the stall cycle of the LBBO.
+	prog := assemble(t, `
+	LDI	r1, 0x1234
+	SBBO	&r1, r0, 0, 4
+	LBBO	&r2, r0, 0, 4
+	HALT
+`)
+	if err := u.LoadAndRun(prog); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u)
+	if c, s := u.Cycles(), u.Stalls(); c != 0 || s != 0 {
+		t.Errorf("disabled counters: got %d cycles, %d stalls", c, s)
+	}
+	u.EnableCounters(true)
+	for i := 1; i <= 2; i++ {
+		// The counters remain enabled when the unit is run again.
+		if err := u.Run(); err != nil {
+			t.Fatal(err)
+		}
+		waitHalt(t, u)
+		if c, s := u.Cycles(), u.Stalls(); c != uint32(5*i) || s != uint32(i) {
+			t.Errorf("run %d: got %d cycles, %d stalls, want %d, %d", i, c, s, 5*i, i)
+		}
+	}
+	if e := u.Elapsed(); e != 50*time.Nanosecond {
+		t.Errorf("Elapsed: got %v, want 50ns", e)
+	}
+	u.ResetCounters()
+	if c, s := u.Cycles(), u.Stalls(); c != 0 || s != 0 {
+		t.Errorf("after reset: got %d cycles, %d stalls", c, s)
+	}
+	u.EnableCounters(false)
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u)
+	if c := u.Cycles(); c != 0 {
+		t.Errorf("after disable: got %d cycles", c)
+	}
+	// The elapsed time of the largest count does not overflow.
+	s.Store(0x22000+c_CYCLE, 0xFFFFFFFF)
+	if e := u.Elapsed(); e != 0xFFFFFFFF*5*time.Nanosecond {
+		t.Errorf("Elapsed: got %v, want %v", e, 0xFFFFFFFF*5*time.Nanosecond)
+	}
+}
+
+func TestWaitHalt(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	u.EnableCounters(true)
+	if err := u.LoadAndRun(storeProg); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	pc, cycles, err := u.WaitHalt(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc != 8 || cycles != 3 {
+		t.Errorf("WaitHalt: got PC %d, %d cycles, want 8, 3", pc, cycles)
+	}
+	// The unit is left running if the context expires.
+	if err := u.LoadAndRun([]uint32{0x79000000}); err != nil { // QBA 0
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := u.WaitHalt(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitHalt: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !u.IsRunning() {
+		t.Errorf("unit halted by expired WaitHalt")
+	}
+}
+
+func TestWaitHaltEvent(t *testing.T) {
+	s, p := openSim(t, NewConfig().EnableUnit(0).Event2Channel(19, 3).Channel2Interrupt(3, 3).HaltPoll(time.Hour))
+	u := p.Unit(0)
+	// The program halts when input 0 is set.
+	prog := assemble(t, `
+loop:
+	QBBC	loop, r31, 0
+	HALT
+`)
+	if err := u.LoadAndRun(prog); err != nil {
+		t.Fatal(err)
+	}
+	e := p.Event(19)
+	type result struct {
+		pc  uint
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		pc, _, err := u.WaitHaltEvent(context.Background(), e)
+		done <- result{pc, err}
+	}()
+	s.SetInputs(0, 1)
+	waitHalt(t, u)
+	// The unit's status is checked when the event is received, not at the poll interval.
+	s.RaiseEvent(19)
+	select {
+	case r := <-done:
+		if r.err != nil || r.pc != 4 {
+			t.Errorf("WaitHaltEvent: got PC %d (%v), want 4", r.pc, r.err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("WaitHaltEvent did not return")
+	}
+}
+
+// TestWaitHaltClosed checks that WaitHaltEvent returns when the PRU is closed.
+func TestWaitHaltClosed(t *testing.T) {
+	// The unit is left running when the PRU is closed.
+	pc := NewConfig().EnableUnit(0).Event2Channel(19, 3).Channel2Interrupt(3, 3).HaltPoll(time.Hour).NoReset()
+	p, err := OpenWithBackend(pc, sim.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := p.Unit(0)
+	if err := u.LoadAndRun([]uint32{0x79000000}); err != nil { // QBA 0
+		p.Close()
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := u.WaitHaltEvent(context.Background(), p.Event(19))
+		done <- err
+	}()
+	p.Close()
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("WaitHaltEvent after Close: got %v, want ErrClosed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("WaitHaltEvent not released by Close")
+	}
+}
+
+func TestWaitHaltHandler(t *testing.T) {
+	_, p := openSim(t, DefaultConfig)
+	e := p.Event(19)
+	e.SetHandler(func() {})
+	if _, _, err := p.Unit(0).WaitHaltEvent(context.Background(), e); err == nil {
+		t.Errorf("WaitHaltEvent with a handler: expected error")
+	}
+}
+
+func TestConstTable(t *testing.T) {
+	_, p := openSim(t, NewConfig().EnableUnit(0).EnableUnit(1).ConstBlock(0, 24, 2).ConstPointer(1, 31, 0x1234).ConstBlock(0, 28, 1))
+	u := p.Unit(0)
+	// The configured entries are set when the PRU is opened.
+	if b, err := u.ConstBlock(24); err != nil || b != 2 {
+		t.Errorf("C24 block: got %d (%v), want 2", b, err)
+	}
+	if ptr, err := p.Unit(1).ConstPointer(31); err != nil || ptr != 0x1234 {
+		t.Errorf("unit 1 C31 pointer: got %#x (%v), want 0x1234", ptr, err)
+	}
+	if ptr, err := u.ConstPointer(28); err != nil || ptr != 0 {
+		t.Errorf("C28 pointer: got %#x (%v), want 0", ptr, err)
+	}
+	if err := u.SetConstBlock(25, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetConstPointer(28, 0x0100); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetConstPointer(29, 0xABCD); err != nil {
+		t.Fatal(err)
+	}
+	// Entries sharing a register are unchanged.
+	if b, err := u.ConstBlock(24); err != nil || b != 2 {
+		t.Errorf("C24 block: got %d (%v), want 2", b, err)
+	}
+	c, err := u.Constants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range map[int]uint32{24: 0x00000200, 25: 0x00002300, 28: 0x00010000, 29: 0x49ABCD00} {
+		if c[n] != want {
+			t.Errorf("C%d: got %#x, want %#x", n, c[n], want)
+		}
+	}
+	for _, n := range []int{23, 28} {
+		if err := u.SetConstBlock(n, 1); err == nil {
+			t.Errorf("SetConstBlock(%d): expected error", n)
+		}
+		if _, err := u.ConstBlock(n); err == nil {
+			t.Errorf("ConstBlock(%d): expected error", n)
+		}
+	}
+	for _, n := range []int{27, 32} {
+		if err := u.SetConstPointer(n, 1); err == nil {
+			t.Errorf("SetConstPointer(%d): expected error", n)
+		}
+		if _, err := u.ConstPointer(n); err == nil {
+			t.Errorf("ConstPointer(%d): expected error", n)
+		}
+	}
+	// The program stores via C24, which points to block 2 of the data RAM.
+	prog := assemble(t, `
+	LDI	r1, 0x1234
+	SBCO	&r1, C24, 0, 4
+	HALT
+`)
+	if err := u.LoadAndRun(prog); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt(t, u)
+	if v := p.Order.Uint32(u.Ram[0x200:]); v != 0x1234 {
+		t.Errorf("RAM[0x200]: got %#x, want %#x", v, 0x1234)
+	}
+}
+
+// waitSleep waits for the unit to sleep.
+func waitSleep(t *testing.T, u *Unit) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !u.IsSleeping() {
+		if time.Now().After(deadline) {
+			t.Fatal("unit did not sleep")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWake(t *testing.T) {
+	s, p := openSim(t, DefaultConfig)
+	u := p.Unit(0)
+	prog := assemble(t, `
+	LDI	r1, 1
+	SLP	1
+	LDI	r1, 2
+	HALT
+`)
+	if err := u.LoadAndRun(prog); err != nil {
+		t.Fatal(err)
+	}
+	waitSleep(t, u)
+	if !u.IsRunning() {
+		t.Errorf("sleeping unit not running")
+	}
+	u.Wake()
+	waitHalt(t, u)
+	if u.IsSleeping() {
+		t.Errorf("unit sleeping after Wake")
+	}
+	if r, err := u.Register(1); err != nil || r != 2 {
+		t.Errorf("r1: got %d (%v), want 2", r, err)
+	}
+	// Waking a unit that is not sleeping has no effect.
+	u.Wake()
+	if u.IsRunning() || u.IsSleeping() {
+		t.Errorf("halted unit changed by Wake")
+	}
+	// The unit is woken by an input selected by the wakeup mask.
+	u.SetWakeupMask(1 << 3)
+	if m := u.WakeupMask(); m != 1<<3 {
+		t.Errorf("WakeupMask: got %#x, want %#x", m, 1<<3)
+	}
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	waitSleep(t, u)
+	s.SetInputs(0, 1<<2)
+	time.Sleep(10 * time.Millisecond)
+	if !u.IsSleeping() {
+		t.Errorf("unit woken by an input not in the wakeup mask")
+	}
+	s.SetInputs(0, 1<<3)
+	waitHalt(t, u)
+	if r, err := u.Register(1); err != nil || r != 2 {
+		t.Errorf("r1: got %d (%v), want 2", r, err)
+	}
+}